@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sha256KeyPrefix   = "sha256:"
+	argon2idKeyPrefix = "$argon2id$"
+
+	// keyIDSeparator ends the key id that starts a token for a hashed key, as in <key id>.<secret>
+	keyIDSeparator = "."
+	// maxRejectedTokens bounds the tokens remembered as not matching a hashed key
+	maxRejectedTokens = 1000
+
+	scopeIngest = "ingest"
+	scopeRead   = "read"
+	scopeClear  = "clear"
+	scopeAdmin  = "admin"
+)
+
+var (
+	bcryptKeyPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+	allScopes = []string{scopeIngest, scopeRead, scopeClear, scopeAdmin}
+	// defaultScopes are given to keys without scopes, which is what every key could do before keys had scopes
+	defaultScopes = []string{scopeIngest, scopeRead, scopeClear}
+)
+
+// keyOwner is the user an API key belongs to, along with the scopes of the endpoints the key may use
+type keyOwner struct {
+	userID string
+	// fingerprint identifies the key, as listed by /admin/keys
+	fingerprint string
+	scopes      []string
+}
+
+func (o keyOwner) allows(scope string) bool {
+	return slices.Contains(o.scopes, scope)
+}
+
+// keyScopes returns the scopes of a key, which has the default scopes when none were given
+func keyScopes(scopes []string) ([]string, error) {
+	if scopes == nil {
+		return defaultScopes, nil
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("scopes must not be empty")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(allScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(allScopes, ", "))
+		}
+	}
+	return scopes, nil
+}
+
+// configuredKey is a key in VALID_API_KEYS, given either as the key on its own or as an object
+// with the key or its hash, its scopes and, for a hash, the id that tokens for it start with
+type configuredKey struct {
+	Key    string   `json:"key"`
+	KeyID  string   `json:"key_id"`
+	Scopes []string `json:"scopes"`
+}
+
+func (k *configuredKey) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*k = configuredKey{}
+		return json.Unmarshal(data, &k.Key)
+	}
+
+	// keyObject has no UnmarshalJSON method, so decoding into it does not recurse
+	type keyObject configuredKey
+	var key keyObject
+	if err := json.Unmarshal(data, &key); err != nil {
+		return err
+	}
+	*k = configuredKey(key)
+	return nil
+}
+
+// keyHash is an API key as configured: either the key itself, for backward compatibility,
+// or a salted hash of it so the key is never stored in clear text
+type keyHash interface {
+	matches(token string) bool
+}
+
+// parseKeyHash parses a configured key, which is a salted SHA-256 hash when formatted as
+// sha256:<salt>:<hex digest of salt and key>, a bcrypt hash, an argon2id hash in PHC string
+// format or otherwise the key itself
+func parseKeyHash(key string) (keyHash, error) {
+	switch {
+	case key == "":
+		return nil, errors.New("key is empty")
+	case strings.HasPrefix(key, sha256KeyPrefix):
+		return parseSHA256Key(key)
+	case strings.HasPrefix(key, argon2idKeyPrefix):
+		return parseArgon2idKey(key)
+	case isBcryptHash(key):
+		if _, err := bcrypt.Cost([]byte(key)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return bcryptKey(key), nil
+	default:
+		return plaintextKey(sha256.Sum256([]byte(key))), nil
+	}
+}
+
+func isBcryptHash(key string) bool {
+	for _, prefix := range bcryptKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// plaintextKey is the SHA-256 digest of a key configured in clear text, so keys of
+// different lengths are compared in constant time
+type plaintextKey [sha256.Size]byte
+
+func (k plaintextKey) matches(token string) bool {
+	digest := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(digest[:], k[:]) == 1
+}
+
+type sha256Key struct {
+	salt   string
+	digest []byte
+}
+
+func parseSHA256Key(key string) (sha256Key, error) {
+	salt, digestHex, ok := strings.Cut(strings.TrimPrefix(key, sha256KeyPrefix), ":")
+	if !ok || salt == "" {
+		return sha256Key{}, errors.New("sha256 keys must be formatted as sha256:<salt>:<hex digest>")
+	}
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil || len(digest) != sha256.Size {
+		return sha256Key{}, errors.New("sha256 key digest must be 64 hexadecimal characters")
+	}
+	return sha256Key{salt: salt, digest: digest}, nil
+}
+
+func (k sha256Key) matches(token string) bool {
+	digest := sha256.Sum256([]byte(k.salt + token))
+	return subtle.ConstantTimeCompare(digest[:], k.digest) == 1
+}
+
+type bcryptKey []byte
+
+func (k bcryptKey) matches(token string) bool {
+	return bcrypt.CompareHashAndPassword(k, []byte(token)) == nil
+}
+
+type argon2idKey struct {
+	salt    []byte
+	hash    []byte
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// parseArgon2idKey parses a hash formatted as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+// with the salt and hash in unpadded base64, as output by the argon2 command line tool
+func parseArgon2idKey(key string) (argon2idKey, error) {
+	parts := strings.Split(key, "$")
+	if len(parts) != 6 {
+		return argon2idKey{}, errors.New("argon2id keys must be formatted as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2idKey{}, fmt.Errorf("argon2id key version must be v=%d", argon2.Version)
+	}
+
+	var k argon2idKey
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &k.memory, &k.time, &k.threads); err != nil {
+		return argon2idKey{}, fmt.Errorf("invalid argon2id key parameters %q: %w", parts[3], err)
+	}
+	if k.time == 0 || k.threads == 0 {
+		return argon2idKey{}, errors.New("argon2id key time and parallelism must be positive")
+	}
+
+	var err error
+	if k.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return argon2idKey{}, fmt.Errorf("invalid argon2id key salt: %w", err)
+	}
+	if k.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(k.hash) == 0 {
+		return argon2idKey{}, errors.New("invalid argon2id key hash")
+	}
+	return k, nil
+}
+
+func (k argon2idKey) matches(token string) bool {
+	hash := argon2.IDKey([]byte(token), k.salt, k.time, k.memory, k.threads, uint32(len(k.hash)))
+	return subtle.ConstantTimeCompare(hash, k.hash) == 1
+}
+
+type userKeyHash struct {
+	owner keyOwner
+	hash  keyHash
+}
+
+// tokenKeyID returns the key id a token for a hashed key starts with
+func tokenKeyID(token string) (string, bool) {
+	keyID, _, ok := strings.Cut(token, keyIDSeparator)
+	return keyID, ok && keyID != ""
+}
+
+// apiKeyring authenticates bearer tokens against the keys configured for each user
+type apiKeyring struct {
+	users map[string]struct{}
+	// keys describes every key, identified by the fingerprint of the key or of its hash
+	keys []apiKeyInfo
+	// plaintext indexes the keys configured in clear text by their SHA-256 digest. Looking up
+	// a token's digest takes the same time whichever key it matches.
+	plaintext map[[sha256.Size]byte]keyOwner
+	// hashed indexes the keys configured as salted hashes by their key id, which is not secret,
+	// so a token is only checked against the one hash its key id names
+	hashed map[string]userKeyHash
+
+	// mu protects verified and rejected, which are shared by every request
+	mu sync.RWMutex
+	// verified indexes the digests of tokens that matched a hashed key, so a slow bcrypt or
+	// argon2id hash is only computed the first time a token is used
+	verified map[[sha256.Size]byte]keyOwner
+	// rejected holds the digests of recent tokens that named a hashed key but did not match it,
+	// so repeating a wrong token does not compute the hash again
+	rejected map[[sha256.Size]byte]struct{}
+}
+
+func newAPIKeyring(userKeys map[string][]configuredKey) (*apiKeyring, error) {
+	k := &apiKeyring{
+		users:     make(map[string]struct{}, len(userKeys)),
+		plaintext: map[[sha256.Size]byte]keyOwner{},
+		hashed:    map[string]userKeyHash{},
+		verified:  map[[sha256.Size]byte]keyOwner{},
+		rejected:  map[[sha256.Size]byte]struct{}{},
+	}
+	for userID, keys := range userKeys {
+		k.users[userID] = struct{}{}
+		for i, key := range keys {
+			hash, err := parseKeyHash(key.Key)
+			if err != nil {
+				return nil, fmt.Errorf("key %d of user %s: %w", i+1, userID, err)
+			}
+			scopes, err := keyScopes(key.Scopes)
+			if err != nil {
+				return nil, fmt.Errorf("key %d of user %s: %w", i+1, userID, err)
+			}
+			owner := keyOwner{userID: userID, fingerprint: fingerprint(sha256.Sum256([]byte(key.Key))), scopes: scopes}
+			k.keys = append(k.keys, apiKeyInfo{
+				UserID:      userID,
+				Fingerprint: owner.fingerprint,
+				Source:      keySourceConfig,
+				Scopes:      scopes,
+			})
+
+			digest, ok := hash.(plaintextKey)
+			if !ok {
+				if key.KeyID == "" || strings.Contains(key.KeyID, keyIDSeparator) {
+					return nil, fmt.Errorf("key %d of user %s is a hash, which needs a key_id without %q that its tokens start with",
+						i+1, userID, keyIDSeparator)
+				}
+				if other, ok := k.hashed[key.KeyID]; ok {
+					return nil, fmt.Errorf("key %d of user %s has the same key_id as a key of user %s", i+1, userID, other.owner.userID)
+				}
+				k.hashed[key.KeyID] = userKeyHash{owner: owner, hash: hash}
+				continue
+			}
+			if key.KeyID != "" {
+				return nil, fmt.Errorf("key %d of user %s has a key_id, which is only used with hashed keys", i+1, userID)
+			}
+			if other, ok := k.plaintext[digest]; ok {
+				return nil, fmt.Errorf("key %d of user %s is also a key of user %s", i+1, userID, other.userID)
+			}
+			k.plaintext[digest] = owner
+		}
+	}
+	return k, nil
+}
+
+func (k *apiKeyring) hasUser(userID string) bool {
+	_, ok := k.users[userID]
+	return ok
+}
+
+// list describes the keys of the user, or of every user when userID is empty
+func (k *apiKeyring) list(userID string) []apiKeyInfo {
+	var keys []apiKeyInfo
+	for _, key := range k.keys {
+		if userID == "" || key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (k *apiKeyring) hasFingerprint(userID, keyFingerprint string) bool {
+	for _, key := range k.keys {
+		if key.UserID == userID && key.Fingerprint == keyFingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the owner of the key that matches the token
+func (k *apiKeyring) authenticate(token string) (keyOwner, bool) {
+	if token == "" {
+		return keyOwner{}, false
+	}
+
+	digest := sha256.Sum256([]byte(token))
+	if owner, ok := k.plaintext[digest]; ok {
+		return owner, true
+	}
+
+	k.mu.RLock()
+	owner, ok := k.verified[digest]
+	_, rejected := k.rejected[digest]
+	k.mu.RUnlock()
+	if ok {
+		return owner, true
+	}
+	if rejected {
+		return keyOwner{}, false
+	}
+
+	keyID, ok := tokenKeyID(token)
+	if !ok {
+		return keyOwner{}, false
+	}
+	key, ok := k.hashed[keyID]
+	if !ok {
+		return keyOwner{}, false
+	}
+
+	matched := key.hash.matches(token)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !matched {
+		if len(k.rejected) >= maxRejectedTokens {
+			k.rejected = map[[sha256.Size]byte]struct{}{}
+		}
+		k.rejected[digest] = struct{}{}
+		return keyOwner{}, false
+	}
+	k.verified[digest] = key.owner
+	return key.owner, true
+}
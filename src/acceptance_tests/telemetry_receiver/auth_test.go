@@ -0,0 +1,179 @@
+package main_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Hashed API keys", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+
+		sha256Hash   string
+		bcryptHash   string
+		argon2idHash string
+	)
+
+	BeforeEach(func() {
+		sha256Hash = "sha256:some-salt:" + sha256Hex([]byte("some-salt"+"sha.sha256-token"))
+
+		bcryptBytes, err := bcrypt.GenerateFromPassword([]byte("bc.bcrypt-token"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		bcryptHash = string(bcryptBytes)
+
+		salt := []byte("some-argon2-salt")
+		argon2idHash = fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("ar.argon2id-token"), salt, 1, 64, 1, 32)))
+
+		apiKeys, err := json.Marshal(map[string][]interface{}{
+			"user-id":  {"plaintext-token", map[string]string{"key": sha256Hash, "key_id": "sha"}},
+			"user-id2": {map[string]string{"key": bcryptHash, "key_id": "bc"}, map[string]string{"key": argon2idHash, "key_id": "ar"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		session, serverUrl = startServerAndWait(map[string]string{
+			ApiKeysEnvVar:     string(apiKeys),
+			AdminApiKeyEnvVar: "sha256:admin-salt:" + sha256Hex([]byte("admin-salt"+"admin-token")),
+		})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	post := func(authHeaderContent string) {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", authHeaderContent, generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+	}
+
+	statusFor := func(url, authHeaderContent string) int {
+		resp := makeRequest(http.MethodGet, url, authHeaderContent, nil)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("authenticates users by hashed keys alongside plaintext keys", func() {
+		post("Bearer sha.sha256-token")
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer plaintext-token")).To(HaveLen(2))
+
+		post("Bearer bc.bcrypt-token")
+		post("Bearer bc.bcrypt-token")
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer ar.argon2id-token")).To(HaveLen(4))
+	})
+
+	It("rejects other tokens, including the hashes themselves", func() {
+		for _, token := range []string{"wrong-token", sha256Hash, bcryptHash, argon2idHash, "bc.wrong-token", "bc.wrong-token",
+			"ar.bcrypt-token", "unknown.bcrypt-token", "bcrypt-token"} {
+			Expect(statusFor(serverUrl+"/received_messages", "Bearer "+token)).To(Equal(http.StatusUnauthorized), token)
+		}
+	})
+
+	It("accepts a hashed admin key", func() {
+		Expect(statusFor(serverUrl+"/admin/faults", "Bearer admin-token")).To(Equal(http.StatusOK))
+		Expect(statusFor(serverUrl+"/admin/faults", "Bearer admin-salt")).To(Equal(http.StatusUnauthorized))
+	})
+
+	DescribeTable("when a key is invalid, it exits nonzero",
+		func(apiKeys string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      apiKeys,
+				MessageLimitEnvVar: "50",
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidApiKeyError + ": " + ApiKeysEnvVar))
+		},
+		Entry("empty", `{"user-id": [""]}`),
+		Entry("sha256 without a salt", `{"user-id": ["sha256:abcd"]}`),
+		Entry("sha256 with a short digest", `{"user-id": ["sha256:salt:abcd"]}`),
+		Entry("bcrypt", `{"user-id": ["$2a$10$tooshort"]}`),
+		Entry("argon2id", `{"user-id": [{"key": "$argon2id$v=19$m=64,t=1$c2FsdA$aGFzaA", "key_id": "ar"}]}`),
+		Entry("shared by two users", `{"user-id": ["1234"], "user-id2": ["1234"]}`),
+		Entry("a hash without a key id", `{"user-id": ["sha256:salt:`+sha256Hex([]byte("salt"+"key"))+`"]}`),
+		Entry("a key id with a separator", `{"user-id": [{"key": "sha256:salt:`+sha256Hex([]byte("salt"+"key"))+`", "key_id": "a.b"}]}`),
+		Entry("a key id shared by two hashes", `{"user-id": [{"key": "sha256:salt:`+sha256Hex([]byte("salt"+"a.1"))+`", "key_id": "a"}],
+			"user-id2": [{"key": "sha256:salt:`+sha256Hex([]byte("salt"+"a.2"))+`", "key_id": "a"}]}`),
+		Entry("a key id on a plaintext key", `{"user-id": [{"key": "1234", "key_id": "a"}]}`),
+	)
+})
+
+var _ = Describe("Authorization headers", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{
+			ApiKeysEnvVar: `{"user-id": ["1234"], "user-id2": [{"key": "ingest-token", "scopes": ["ingest"]}]}`,
+		})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	getWithHeaders := func(headers map[string]string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, serverUrl+"/received_messages", nil)
+		Expect(err).NotTo(HaveOccurred())
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	DescribeTable("accepts the key",
+		func(headers map[string]string) {
+			resp := getWithHeaders(headers)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		},
+		Entry("with a lower case scheme", map[string]string{"Authorization": "bearer 1234"}),
+		Entry("with an upper case scheme", map[string]string{"Authorization": "BEARER 1234"}),
+		Entry("in the X-Api-Key header", map[string]string{ApiKeyHeader: "1234"}),
+		Entry("preferring the Authorization header", map[string]string{"Authorization": "Bearer 1234", ApiKeyHeader: "wrong-token"}),
+	)
+
+	DescribeTable("explains why a request was rejected",
+		func(headers map[string]string, status int, reason, challenge string) {
+			resp := getWithHeaders(headers)
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(status))
+			Expect(resp.Header.Get("WWW-Authenticate")).To(Equal(challenge))
+
+			var body map[string]string
+			Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+			Expect(body).To(HaveKeyWithValue("reason", reason))
+			Expect(body).To(HaveKeyWithValue("error", Not(BeEmpty())))
+		},
+		Entry("missing", map[string]string{}, http.StatusUnauthorized, "missing_token",
+			`Bearer realm="telemetry-receiver"`),
+		Entry("malformed", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, http.StatusUnauthorized, "malformed_token",
+			`Bearer realm="telemetry-receiver", error="invalid_request", error_description="Authorization header must be formatted as Bearer <key>"`),
+		Entry("without a key", map[string]string{"Authorization": "Bearer"}, http.StatusUnauthorized, "malformed_token",
+			`Bearer realm="telemetry-receiver", error="invalid_request", error_description="Authorization header must be formatted as Bearer <key>"`),
+		Entry("unknown", map[string]string{ApiKeyHeader: "wrong-token"}, http.StatusUnauthorized, "unknown_token",
+			`Bearer realm="telemetry-receiver", error="invalid_token", error_description="API key is not valid"`),
+		Entry("out of scope", map[string]string{"Authorization": "Bearer ingest-token"}, http.StatusForbidden, "insufficient_scope",
+			`Bearer realm="telemetry-receiver", error="insufficient_scope", error_description="key does not have the read scope", scope="read"`),
+	)
+})
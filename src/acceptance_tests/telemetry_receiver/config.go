@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const (
+	defaultConfigWatchInterval = 5 * time.Second
+
+	configReloadSucceeded = "success"
+	configReloadFailed    = "failure"
+)
+
+// reloadableSettings are applied again, without a restart, when the config file is reloaded
+var reloadableSettings = []string{
+	ApiKeysEnvVar,
+	AdminApiKeyEnvVar,
+	MessageLimitEnvVar,
+	ValidateMessagesEnvVar,
+	MessageTTLEnvVar,
+	UserMessageTTLsEnvVar,
+	MemoryBudgetEnvVar,
+	JanitorIntervalEnvVar,
+	MaxBodySizeEnvVar,
+	MaxDecompressedSizeEnvVar,
+	MaxTarEntriesEnvVar,
+	MaxTarEntrySizeEnvVar,
+	RateLimitsEnvVar,
+	DuplicateBatchesEnvVar,
+	IdempotencyWindowEnvVar,
+}
+
+// restartSettings only take effect when the receiver starts
+var restartSettings = []string{
+	PortEnvVar,
+	MessageStoreEnvVar,
+	MessageStorePathEnvVar,
+	StreamBufferSizeEnvVar,
+	ReadHeaderTimeoutEnvVar,
+	ReadTimeoutEnvVar,
+	WriteTimeoutEnvVar,
+	IdleTimeoutEnvVar,
+	ShutdownTimeoutEnvVar,
+	ForwardPortEnvVar,
+	ForwardUserIDEnvVar,
+	ForwardTLSCertPathEnvVar,
+	ForwardTLSKeyPathEnvVar,
+	ForwardTLSCAPathEnvVar,
+	ForwardSharedKeyEnvVar,
+	ForwardHostnameEnvVar,
+}
+
+// configSource looks up settings by the name of their environment variable, preferring
+// the values set in the config file
+type configSource map[string]string
+
+func (c configSource) get(envVar string) string {
+	if value, ok := c[envVar]; ok {
+		return value
+	}
+	return os.Getenv(envVar)
+}
+
+// parseConfigFile parses the contents of a YAML or JSON config file. Its keys are the
+// names of the environment variables it replaces in lower case, such as message_limit.
+func parseConfigFile(path string, contents []byte) (configSource, error) {
+	// YAML is a superset of JSON, so this parses both
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(contents, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	source := make(configSource, len(settings))
+	for key, value := range settings {
+		envVar := strings.ToUpper(key)
+		if !slices.Contains(reloadableSettings, envVar) && !slices.Contains(restartSettings, envVar) {
+			return nil, fmt.Errorf("unknown setting %s in %s", key, path)
+		}
+
+		switch value := value.(type) {
+		case nil:
+			continue
+		case string:
+			source[envVar] = value
+		case map[string]interface{}, []interface{}:
+			// Settings such as valid_api_keys take JSON, as their environment variables do
+			valueBytes, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			source[envVar] = string(valueBytes)
+		default:
+			source[envVar] = fmt.Sprint(value)
+		}
+	}
+	return source, nil
+}
+
+// reloadableConfig holds the settings that can change while the receiver is running.
+// Handlers read it through currentConfig, as a reload may replace it at any time.
+type reloadableConfig struct {
+	apiKeys *apiKeyring
+
+	// adminApiKey grants access to the /admin endpoints, which are disabled when it is nil
+	adminApiKey keyHash
+
+	messageLimit int
+
+	// validateMessages enforces the telemetry message contract on messages sent to /components
+	validateMessages bool
+
+	limits sizeLimits
+
+	retention retentionPolicy
+
+	// rateLimits throttle each API key's requests to each endpoint, which are unlimited when nil
+	rateLimits rateLimits
+
+	// rejectDuplicateBatches responds to duplicate batches with 409 Conflict instead of flagging them
+	rejectDuplicateBatches bool
+
+	// idempotencyWindow is how long responses are replayed for a repeated Idempotency-Key
+	idempotencyWindow time.Duration
+}
+
+var activeConfig atomic.Pointer[reloadableConfig]
+
+func currentConfig() *reloadableConfig {
+	return activeConfig.Load()
+}
+
+func parseReloadableConfig(source configSource) (*reloadableConfig, error) {
+	for _, e := range []string{ApiKeysEnvVar, MessageLimitEnvVar} {
+		if source.get(e) == "" {
+			return nil, fmt.Errorf(RequiredEnvVarNotSetErrorFormat, e)
+		}
+	}
+
+	config := &reloadableConfig{}
+	var userApiKeys map[string][]configuredKey
+	err := json.Unmarshal([]byte(source.get(ApiKeysEnvVar)), &userApiKeys)
+	if err != nil {
+		return nil, fmt.Errorf(FailedUnmarshalErrorFormat+": %w", ApiKeysEnvVar, err)
+	}
+	config.apiKeys, err = newAPIKeyring(userApiKeys)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidApiKeyError+": %s: %w", ApiKeysEnvVar, err)
+	}
+
+	config.messageLimit, err = strconv.Atoi(source.get(MessageLimitEnvVar))
+	if err != nil {
+		return nil, fmt.Errorf(InvalidMessageLimitError+": %w", err)
+	}
+
+	config.retention, err = parseRetentionPolicy(source)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidRetentionError+": %w", err)
+	}
+
+	if value := source.get(AdminApiKeyEnvVar); value != "" {
+		config.adminApiKey, err = parseKeyHash(value)
+		if err != nil {
+			return nil, fmt.Errorf(InvalidApiKeyError+": %s: %w", AdminApiKeyEnvVar, err)
+		}
+	}
+
+	if source.get(ForwardPortEnvVar) != "" {
+		forwardUserID := source.get(ForwardUserIDEnvVar)
+		if !config.apiKeys.hasUser(forwardUserID) {
+			return nil, fmt.Errorf(InvalidForwardConfigError+": %s must name a user in %s", ForwardUserIDEnvVar, ApiKeysEnvVar)
+		}
+	}
+
+	if value := source.get(ValidateMessagesEnvVar); value != "" {
+		config.validateMessages, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf(InvalidValidateMessagesError+": %w", err)
+		}
+	}
+
+	config.limits, err = parseSizeLimits(source)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidSizeLimitError+": %w", err)
+	}
+
+	config.rateLimits, err = parseRateLimits(source)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidRateLimitError+": %w", err)
+	}
+
+	config.rejectDuplicateBatches, err = parseDuplicateBatches(source)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidDuplicateBatchesError+": %w", err)
+	}
+
+	config.idempotencyWindow, err = parseIdempotencyWindow(source)
+	if err != nil {
+		return nil, fmt.Errorf(InvalidIdempotencyWindowError+": %w", err)
+	}
+
+	return config, nil
+}
+
+// configWatcher reloads the config file on SIGHUP, or when its contents change
+type configWatcher struct {
+	path     string
+	interval time.Duration
+	// source and contents are what was last read from the file
+	source   configSource
+	contents []byte
+	hangups  chan os.Signal
+}
+
+func newConfigWatcher(path string, source configSource, contents []byte) (*configWatcher, error) {
+	interval := defaultConfigWatchInterval
+	if value := os.Getenv(ConfigWatchIntervalEnvVar); value != "" {
+		var err error
+		interval, err = parsePositiveDuration(ConfigWatchIntervalEnvVar, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := &configWatcher{
+		path:     path,
+		interval: interval,
+		source:   source,
+		contents: contents,
+		hangups:  make(chan os.Signal, 1),
+	}
+	// Registered before the receiver starts, so an early SIGHUP does not terminate it
+	signal.Notify(w.hangups, syscall.SIGHUP)
+	return w, nil
+}
+
+func (w *configWatcher) watch() {
+	defer signal.Stop(w.hangups)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.hangups:
+			w.reload()
+		case <-ticker.C:
+			contents, err := os.ReadFile(w.path)
+			if err != nil {
+				// Reported by reload if the file is still unreadable on SIGHUP
+				continue
+			}
+			if !bytes.Equal(contents, w.contents) {
+				w.reload()
+			}
+		case <-shuttingDown:
+			return
+		}
+	}
+}
+
+// reload applies the config file's reloadable settings, keeping the current configuration
+// and stored messages if the file is invalid
+func (w *configWatcher) reload() {
+	contents, err := os.ReadFile(w.path)
+	if err != nil {
+		w.reloadFailed(err)
+		return
+	}
+	// Invalid contents are not retried on every tick
+	w.contents = contents
+
+	source, err := parseConfigFile(w.path, contents)
+	if err != nil {
+		w.reloadFailed(err)
+		return
+	}
+	config, err := parseReloadableConfig(source)
+	if err != nil {
+		w.reloadFailed(err)
+		return
+	}
+
+	for _, setting := range restartSettings {
+		if source.get(setting) != w.source.get(setting) {
+			log.Printf("Warning: %s changed in config file %s, but only takes effect when the receiver restarts", strings.ToLower(setting), w.path)
+		}
+	}
+	w.source = source
+
+	activeConfig.Store(config)
+	if err := messageStore.Reconfigure(config.messageLimit, config.retention); err != nil {
+		log.Printf("Error evicting messages beyond the reloaded limits: %v", err)
+	}
+	reconfigureJanitor()
+	metrics.configReloads.inc(configReloadSucceeded)
+	log.Printf("Reloaded config file %s", w.path)
+}
+
+func (w *configWatcher) reloadFailed(err error) {
+	metrics.configReloads.inc(configReloadFailed)
+	log.Printf("Error reloading config file %s, keeping the current configuration: %v", w.path, err)
+}
@@ -0,0 +1,197 @@
+package main_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Config file", func() {
+	var (
+		session    *gexec.Session
+		serverUrl  string
+		configPath string
+		envs       map[string]string
+	)
+
+	// writeConfig replaces the config file in one step, so the receiver never reads it half written
+	writeConfig := func(contents string) {
+		tmpPath := configPath + ".tmp"
+		Expect(os.WriteFile(tmpPath, []byte(contents), 0600)).To(Succeed())
+		Expect(os.Rename(tmpPath, configPath)).To(Succeed())
+	}
+
+	statusFor := func(authHeaderContent string) int {
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", authHeaderContent, nil)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	BeforeEach(func() {
+		configPath = filepath.Join(GinkgoT().TempDir(), "config.yml")
+		writeConfig(`
+valid_api_keys:
+  user-id: [file-token]
+message_limit: 2
+`)
+		envs = map[string]string{ConfigFileEnvVar: configPath}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("prefers the settings in the file to environment variables", func() {
+		Expect(statusFor("Bearer file-token")).To(Equal(http.StatusOK))
+		Expect(statusFor(validTokenContent)).To(Equal(http.StatusUnauthorized))
+
+		for i := 0; i < 3; i++ {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer file-token", generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		}
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer file-token")).To(HaveLen(2))
+	})
+
+	Context("when the file is JSON", func() {
+		BeforeEach(func() {
+			writeConfig(`{"valid_api_keys": {"user-id": ["json-token"]}, "max_body_size": 1000}`)
+		})
+
+		It("reads it", func() {
+			Expect(statusFor("Bearer json-token")).To(Equal(http.StatusOK))
+		})
+	})
+
+	It("reloads keys on SIGHUP without dropping stored messages", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer file-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		writeConfig(`
+valid_api_keys:
+  user-id: [rotated-token]
+message_limit: 2
+`)
+		session.Signal(syscall.SIGHUP)
+
+		Eventually(func() int { return statusFor("Bearer rotated-token") }).Should(Equal(http.StatusOK))
+		Expect(statusFor("Bearer file-token")).To(Equal(http.StatusUnauthorized))
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer rotated-token")).To(HaveLen(2))
+		Expect(getMetrics(serverUrl)).To(ContainSubstring(`telemetry_receiver_config_reloads_total{result="success"} 1` + "\n"))
+	})
+
+	It("applies a lowered message limit to the stored messages straight away", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer file-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		writeConfig(`
+valid_api_keys:
+  user-id: [file-token]
+message_limit: 1
+`)
+		session.Signal(syscall.SIGHUP)
+		Eventually(session.Err).Should(gbytes.Say("Reloaded config file"))
+
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer file-token")).To(HaveLen(1))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", "Bearer file-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer file-token")).To(HaveLen(1))
+	})
+
+	It("applies a lowered memory budget to the stored messages straight away", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer file-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		writeConfig(`
+valid_api_keys:
+  user-id: [file-token]
+message_limit: 2
+memory_budget: 1
+`)
+		session.Signal(syscall.SIGHUP)
+		Eventually(session.Err).Should(gbytes.Say("Reloaded config file"))
+
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer file-token")).To(BeEmpty())
+		Expect(getMetrics(serverUrl)).To(ContainSubstring(
+			`telemetry_receiver_evictions_total{user="user-id",collection="messages",reason="memory_budget"} 2` + "\n"))
+	})
+
+	It("keeps the current configuration when the reloaded file is invalid", func() {
+		writeConfig(`
+valid_api_keys:
+  user-id: [rotated-token]
+message_limit: lots
+`)
+		session.Signal(syscall.SIGHUP)
+
+		Eventually(session.Err).Should(gbytes.Say("Error reloading config file .*" + InvalidMessageLimitError))
+		Expect(session).NotTo(gexec.Exit())
+		Expect(statusFor("Bearer file-token")).To(Equal(http.StatusOK))
+		Expect(statusFor("Bearer rotated-token")).To(Equal(http.StatusUnauthorized))
+		Expect(getMetrics(serverUrl)).To(ContainSubstring(`telemetry_receiver_config_reloads_total{result="failure"} 1` + "\n"))
+	})
+
+	It("warns that settings which need a restart were not applied", func() {
+		writeConfig(`
+valid_api_keys:
+  user-id: [file-token]
+message_limit: 2
+stream_buffer_size: 10
+`)
+		session.Signal(syscall.SIGHUP)
+
+		Eventually(session.Err).Should(gbytes.Say("stream_buffer_size changed .* only takes effect when the receiver restarts"))
+	})
+
+	Context("with a watch interval", func() {
+		BeforeEach(func() {
+			envs[ConfigWatchIntervalEnvVar] = "100ms"
+		})
+
+		It("reloads the file when it changes", func() {
+			writeConfig(`
+valid_api_keys:
+  user-id: [rotated-token]
+message_limit: 2
+`)
+			Eventually(func() int { return statusFor("Bearer rotated-token") }).
+				WithTimeout(2 * time.Second).Should(Equal(http.StatusOK))
+		})
+	})
+
+	DescribeTable("when the config file is invalid at startup, it exits nonzero",
+		func(contents, message string) {
+			writeConfig(contents)
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar: "50",
+				ConfigFileEnvVar:   configPath,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(message))
+		},
+		Entry("unparseable", "valid_api_keys: [", InvalidConfigFileError),
+		Entry("unknown setting", "message_limits: 2", InvalidConfigFileError+": unknown setting message_limits"),
+		Entry("invalid setting", "message_limit: lots", InvalidMessageLimitError),
+	)
+})
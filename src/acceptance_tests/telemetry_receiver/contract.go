@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// requiredCentralizerFields are added to every message by the centralizer's
+// record_transformer filter before it is sent to /components
+var requiredCentralizerFields = []string{
+	"telemetry-centralizer-version",
+	"telemetry-foundation-id",
+	"telemetry-env-type",
+	"telemetry-iaas-type",
+}
+
+type contractViolation struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type messageViolations struct {
+	Line       int                 `json:"line"`
+	Violations []contractViolation `json:"violations"`
+}
+
+// contractError is returned when messages sent to /components do not satisfy the
+// telemetry message contract
+type contractError struct {
+	Messages []messageViolations
+}
+
+func (e *contractError) Error() string {
+	lines := make([]string, 0, len(e.Messages))
+	for _, m := range e.Messages {
+		lines = append(lines, fmt.Sprintf("%d", m.Line))
+	}
+	return fmt.Sprintf("messages on lines %s violate the telemetry message contract", strings.Join(lines, ", "))
+}
+
+// validateTelemetryMessage checks a message against the contract enforced by the
+// agent's filter_telemetry.rb plugin, along with the fields the centralizer adds
+func validateTelemetryMessage(message map[string]interface{}) []contractViolation {
+	var violations []contractViolation
+
+	if violation := requireString(message, "telemetry-source"); violation != nil {
+		violations = append(violations, *violation)
+	}
+
+	if violation := requireString(message, "telemetry-time"); violation != nil {
+		violations = append(violations, *violation)
+	} else if _, err := time.Parse(time.RFC3339, message["telemetry-time"].(string)); err != nil {
+		violations = append(violations, contractViolation{
+			Field:  "telemetry-time",
+			Reason: "must be in date/time format RFC 3339",
+		})
+	}
+
+	for _, field := range requiredCentralizerFields {
+		if violation := requireString(message, field); violation != nil {
+			violations = append(violations, *violation)
+		}
+	}
+
+	return violations
+}
+
+func requireString(message map[string]interface{}, field string) *contractViolation {
+	value, ok := message[field]
+	if !ok {
+		return &contractViolation{Field: field, Reason: "is required"}
+	}
+	strValue, ok := value.(string)
+	if !ok {
+		return &contractViolation{Field: field, Reason: "must be a string"}
+	}
+	if strValue == "" {
+		return &contractViolation{Field: field, Reason: "must not be empty"}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Message validation", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{ValidateMessagesEnvVar: "true"})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("stores messages that satisfy the telemetry message contract", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, []byte(
+			validCentralizerMsg("2009-11-10T23:00:00Z")+"\n"+validCentralizerMsg("2009-11-10T23:00:00.123+01:00")+"\n",
+		))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+	})
+
+	It("rejects every message in a request when any message violates the contract", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, []byte(
+			validCentralizerMsg("2009-11-10T23:00:00Z")+"\n"+
+				`{"telemetry-time": "10/11/2009", "telemetry-centralizer-version": "0.0.2", "telemetry-foundation-id": "my-foundation", "telemetry-env-type": "production", "telemetry-iaas-type": 42}`+"\n"+
+				validCentralizerMsg("2009-11-11T23:00:00Z")+"\n"+
+				`{"telemetry-source": "my-component", "telemetry-time": "2009-11-10T23:00:00Z", "telemetry-centralizer-version": "", "telemetry-foundation-id": "my-foundation", "telemetry-env-type": "production"}`+"\n",
+		))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		respBody, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		var violations struct {
+			Error    string `json:"error"`
+			Messages []struct {
+				Line       int                 `json:"line"`
+				Violations []map[string]string `json:"violations"`
+			} `json:"messages"`
+		}
+		Expect(json.Unmarshal(respBody, &violations)).To(Succeed())
+		Expect(violations.Error).To(ContainSubstring("telemetry message contract"))
+		Expect(violations.Messages).To(HaveLen(2))
+		Expect(violations.Messages[0].Line).To(Equal(2))
+		Expect(violations.Messages[0].Violations).To(ConsistOf(
+			map[string]string{"field": "telemetry-source", "reason": "is required"},
+			map[string]string{"field": "telemetry-time", "reason": "must be in date/time format RFC 3339"},
+			map[string]string{"field": "telemetry-iaas-type", "reason": "must be a string"},
+		))
+		Expect(violations.Messages[1].Line).To(Equal(4))
+		Expect(violations.Messages[1].Violations).To(ConsistOf(
+			map[string]string{"field": "telemetry-centralizer-version", "reason": "must not be empty"},
+			map[string]string{"field": "telemetry-iaas-type", "reason": "is required"},
+		))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+	})
+
+	It("when the message validation configuration is invalid, it exits nonzero", func() {
+		errorSession := startServer(binaryPath, "2020", map[string]string{ValidateMessagesEnvVar: "sometimes"})
+		Eventually(errorSession).Should(gexec.Exit(1))
+		Expect(errorSession.Out).To(gbytes.Say(InvalidValidateMessagesError))
+	})
+})
+
+func validCentralizerMsg(telemetryTime string) string {
+	return `{"telemetry-source": "my-component", "telemetry-time": "` + telemetryTime + `", ` +
+		`"telemetry-centralizer-version": "0.0.2", "telemetry-foundation-id": "my-foundation", ` +
+		`"telemetry-env-type": "production", "telemetry-iaas-type": "gcp", "data": {"foo": "bar"}}`
+}
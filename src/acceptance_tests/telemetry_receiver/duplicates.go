@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// duplicateBatchesFlag stores duplicate batches, flagging them on their /received_batches record
+	duplicateBatchesFlag = "flag"
+	// duplicateBatchesReject responds to duplicate batches with 409 Conflict without storing them
+	duplicateBatchesReject = "reject"
+
+	duplicateOutcomeFlagged  = "flagged"
+	duplicateOutcomeRejected = "rejected"
+)
+
+// batchDataset identifies a dataset in a tarball sent to /collections/batch. The collector
+// sends the same dataset again when it retries a send that failed.
+type batchDataset struct {
+	FoundationId string
+	CollectedAt  string
+	Dataset      string
+}
+
+// duplicateDataset is a dataset that was already received in an earlier batch
+type duplicateDataset struct {
+	batchDataset
+	// DuplicateOf is the Id of the earliest stored batch that contained the dataset
+	DuplicateOf string
+}
+
+// batchSummary holds the fields of a batch record that duplicates are detected by. Records
+// are decoded into it through JSON, as the file message store returns them decoded from its log,
+// which is only done when a user's batch index is built.
+type batchSummary struct {
+	Id                string
+	ReceivedAt        string
+	Sha256            string
+	Datasets          []batchDataset
+	Duplicate         bool
+	DuplicateOf       string             `json:",omitempty"`
+	DuplicateDatasets []duplicateDataset `json:",omitempty"`
+}
+
+// duplicateBatchError is returned for a duplicate batch when DUPLICATE_BATCHES is reject,
+// and is the body of the 409 Conflict response
+type duplicateBatchError struct {
+	// DuplicateOf is the Id of the earliest stored batch with an identical body
+	DuplicateOf       string             `json:"duplicate_of,omitempty"`
+	DuplicateDatasets []duplicateDataset `json:"duplicate_datasets,omitempty"`
+}
+
+func (e *duplicateBatchError) Error() string {
+	if e.DuplicateOf != "" {
+		return fmt.Sprintf("batch is identical to batch %s", e.DuplicateOf)
+	}
+	return fmt.Sprintf("batch repeats %d datasets of earlier batches", len(e.DuplicateDatasets))
+}
+
+func (e *duplicateBatchError) MarshalJSON() ([]byte, error) {
+	type body duplicateBatchError
+	return json.Marshal(struct {
+		Error string `json:"error"`
+		*body
+	}{Error: e.Error(), body: (*body)(e)})
+}
+
+func parseDuplicateBatches(source configSource) (bool, error) {
+	switch value := source.get(DuplicateBatchesEnvVar); value {
+	case "", duplicateBatchesFlag:
+		return false, nil
+	case duplicateBatchesReject:
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s must be %s or %s, got %q", DuplicateBatchesEnvVar, duplicateBatchesFlag, duplicateBatchesReject, value)
+	}
+}
+
+// batchDeduplicator detects batches that repeat the body, or a dataset, of a batch the same
+// user sent earlier and that is still stored
+type batchDeduplicator struct {
+	// mu protects users, and is only held to find a user's index
+	mu    sync.Mutex
+	users map[string]*batchIndex
+}
+
+func newBatchDeduplicator() *batchDeduplicator {
+	return &batchDeduplicator{users: map[string]*batchIndex{}}
+}
+
+// indexedBatch is a batch in a user's index, at its position among the batches stored since
+// the user's messages were last cleared
+type indexedBatch struct {
+	id       string
+	position int
+}
+
+// batchIndex holds the body checksums and datasets of a user's stored batches, oldest first,
+// so a new batch is compared with them without reading the stored batches back
+type batchIndex struct {
+	// mu is held from checking the user's earlier batches until a new batch is stored, so
+	// concurrent retries of the same batch are not both taken for the original
+	mu sync.Mutex
+	// loaded is false until the index is built from the user's stored batches
+	loaded   bool
+	bodies   map[string][]indexedBatch
+	datasets map[batchDataset][]indexedBatch
+	// next is the position of the next batch stored, and evicted the number of batches
+	// before it that have been evicted and were removed from the index
+	next    int
+	evicted int
+}
+
+// index returns the user's batch index, locked
+func (d *batchDeduplicator) index(userID string) *batchIndex {
+	d.mu.Lock()
+	index, ok := d.users[userID]
+	if !ok {
+		index = &batchIndex{}
+		d.users[userID] = index
+	}
+	d.mu.Unlock()
+
+	index.mu.Lock()
+	return index
+}
+
+// store flags duplicate batches among the received messages and stores them with the
+// receiver metadata, unless DUPLICATE_BATCHES is reject and a batch is a duplicate, in which
+// case nothing is stored and a *duplicateBatchError is returned
+func (d *batchDeduplicator) store(userID string, received collectionMessages, metadata *receiverMetadata) error {
+	batches := received[batchesCollection]
+	if len(batches) == 0 {
+		return updateMessages(userID, received, metadata)
+	}
+
+	index := d.index(userID)
+	defer index.mu.Unlock()
+
+	stored, err := messageStore.Read(batchesCollection, userID)
+	if err != nil {
+		return err
+	}
+	if err := index.load(stored); err != nil {
+		return err
+	}
+	index.forgetEvicted(stored.Evicted)
+
+	summaries := make([]batchSummary, len(batches))
+	for i, batch := range batches {
+		summaries[i] = receivedBatchSummary(batch)
+	}
+	var duplicates []*duplicateBatchError
+	for i, summary := range summaries {
+		duplicate := index.findDuplicates(summary, summaries[:i])
+		batches[i]["Duplicate"] = duplicate != nil
+		if duplicate != nil {
+			if duplicate.DuplicateOf != "" {
+				batches[i]["DuplicateOf"] = duplicate.DuplicateOf
+			}
+			if len(duplicate.DuplicateDatasets) > 0 {
+				batches[i]["DuplicateDatasets"] = duplicate.DuplicateDatasets
+			}
+			duplicates = append(duplicates, duplicate)
+		}
+	}
+
+	if len(duplicates) > 0 && currentConfig().rejectDuplicateBatches {
+		metrics.duplicates.inc(userID, duplicateOutcomeRejected)
+		return duplicates[0]
+	}
+	for range duplicates {
+		metrics.duplicates.inc(userID, duplicateOutcomeFlagged)
+	}
+	if err := updateMessages(userID, received, metadata); err != nil {
+		// The batches may or may not have been stored, so the index is built again
+		index.loaded = false
+		return err
+	}
+	for _, summary := range summaries {
+		index.add(summary)
+	}
+	return nil
+}
+
+// clear clears the user's messages while none of their batches are being stored, and
+// forgets their batches
+func (d *batchDeduplicator) clear(userID string) error {
+	index := d.index(userID)
+	defer index.mu.Unlock()
+
+	index.loaded = false
+	return messageStore.Clear(userID)
+}
+
+// load builds the index from the user's stored batches, unless it already has been. Callers
+// must hold x.mu.
+func (x *batchIndex) load(stored storedMessages) error {
+	if x.loaded {
+		return nil
+	}
+	summaries, err := decodeBatchSummaries(stored.Messages)
+	if err != nil {
+		return err
+	}
+
+	x.bodies = map[string][]indexedBatch{}
+	x.datasets = map[batchDataset][]indexedBatch{}
+	x.next = stored.Evicted
+	x.evicted = stored.Evicted
+	for _, summary := range summaries {
+		x.add(summary)
+	}
+	x.loaded = true
+	return nil
+}
+
+// add indexes a batch that was just stored. Callers must hold x.mu.
+func (x *batchIndex) add(summary batchSummary) {
+	batch := indexedBatch{id: summary.Id, position: x.next}
+	x.next++
+	if summary.Sha256 != "" {
+		x.bodies[summary.Sha256] = append(x.bodies[summary.Sha256], batch)
+	}
+	for _, dataset := range summary.Datasets {
+		x.datasets[dataset] = append(x.datasets[dataset], batch)
+	}
+}
+
+// forgetEvicted removes the batches that have been evicted since the index was last used.
+// Batches are evicted oldest first, so they are the ones before position evicted. Callers
+// must hold x.mu.
+func (x *batchIndex) forgetEvicted(evicted int) {
+	if evicted <= x.evicted {
+		return
+	}
+	x.evicted = evicted
+	forgetBefore(x.bodies, evicted)
+	forgetBefore(x.datasets, evicted)
+}
+
+func forgetBefore[K comparable](index map[K][]indexedBatch, position int) {
+	for key, batches := range index {
+		for len(batches) > 0 && batches[0].position < position {
+			batches = batches[1:]
+		}
+		if len(batches) == 0 {
+			delete(index, key)
+		} else {
+			index[key] = batches
+		}
+	}
+}
+
+// findDuplicates compares a batch with the indexed batches and then with the batches received
+// before it in the same request, and returns nil when it repeats neither the body nor any
+// dataset of one of them. Callers must hold x.mu.
+func (x *batchIndex) findDuplicates(batch batchSummary, received []batchSummary) *duplicateBatchError {
+	duplicate := &duplicateBatchError{}
+	for _, dataset := range batch.Datasets {
+		if previous := x.datasets[dataset]; len(previous) > 0 {
+			duplicate.DuplicateDatasets = append(duplicate.DuplicateDatasets, duplicateDataset{
+				batchDataset: dataset,
+				DuplicateOf:  previous[0].id,
+			})
+			continue
+		}
+		for _, previous := range received {
+			if containsDataset(previous.Datasets, dataset) {
+				duplicate.DuplicateDatasets = append(duplicate.DuplicateDatasets, duplicateDataset{
+					batchDataset: dataset,
+					DuplicateOf:  previous.Id,
+				})
+				break
+			}
+		}
+	}
+	if previous := x.bodies[batch.Sha256]; batch.Sha256 != "" && len(previous) > 0 {
+		duplicate.DuplicateOf = previous[0].id
+	} else {
+		for _, previous := range received {
+			if previous.Sha256 != "" && previous.Sha256 == batch.Sha256 {
+				duplicate.DuplicateOf = previous.Id
+				break
+			}
+		}
+	}
+
+	if duplicate.DuplicateOf == "" && len(duplicate.DuplicateDatasets) == 0 {
+		return nil
+	}
+	return duplicate
+}
+
+func containsDataset(datasets []batchDataset, dataset batchDataset) bool {
+	for _, d := range datasets {
+		if d == dataset {
+			return true
+		}
+	}
+	return false
+}
+
+// receivedBatchSummary returns the summary of a batch record just built by readTarBatch
+func receivedBatchSummary(batch map[string]interface{}) batchSummary {
+	datasets, _ := batch["Datasets"].([]batchDataset)
+	return batchSummary{
+		Id:       getString(batch, "Id", ""),
+		Sha256:   getString(batch, "Sha256", ""),
+		Datasets: datasets,
+	}
+}
+
+func decodeBatchSummaries(batches []map[string]interface{}) ([]batchSummary, error) {
+	batchBytes, err := json.Marshal(batches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode batches: %w", err)
+	}
+	var summaries []batchSummary
+	if err := json.Unmarshal(batchBytes, &summaries); err != nil {
+		return nil, fmt.Errorf("failed to decode batches: %w", err)
+	}
+	return summaries, nil
+}
+
+// readDuplicateBatches responds with the Id, checksum and duplicates of every stored batch
+// that was flagged as a duplicate when it was received
+func readDuplicateBatches(w http.ResponseWriter, r *http.Request) {
+	userID, authed := authorized(w, r, scopeRead)
+	if !authed {
+		return
+	}
+
+	stored, err := messageStore.Read(batchesCollection, userID)
+	if err != nil {
+		log.Printf("Error reading batches for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	summaries, err := decodeBatchSummaries(stored.Messages)
+	if err != nil {
+		log.Printf("Error reading batches for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	duplicates := []batchSummary{}
+	for _, summary := range summaries {
+		if summary.Duplicate {
+			duplicates = append(duplicates, summary)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"duplicates": duplicates})
+}
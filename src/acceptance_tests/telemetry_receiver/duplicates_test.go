@@ -0,0 +1,209 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Duplicate batches", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	send := func(authHeaderContent string, compressed bool, tarball []byte) int {
+		resp := makeBatchRequest(http.MethodPost, serverUrl, authHeaderContent, compressed, tarball)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	getDuplicates := func() []interface{} {
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_batches/duplicates", validTokenContent, nil)
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var body map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body).To(HaveKey("duplicates"))
+		return body["duplicates"].([]interface{})
+	}
+
+	opsmanagerDataset := func(duplicateOf interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"FoundationId": "best-foundation-id",
+			"CollectedAt":  "2006-01-02T15:04:05Z07:00",
+			"Dataset":      "opsmanager",
+			"DuplicateOf":  duplicateOf,
+		}
+	}
+
+	It("flags a batch that is resent with the same body", func() {
+		tarball := generateTarFileContents("best-foundation-id", true)
+		Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+		Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+
+		batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+		Expect(batches).To(HaveLen(2))
+		Expect(batches[0]).To(HaveKeyWithValue("Sha256", sha256Hex(tarball)))
+		Expect(batches[0]).To(HaveKeyWithValue("Duplicate", false))
+		Expect(batches[0]).NotTo(HaveKey("DuplicateOf"))
+		Expect(batches[1]).To(HaveKeyWithValue("Duplicate", true))
+		Expect(batches[1]).To(HaveKeyWithValue("DuplicateOf", batches[0]["Id"]))
+		Expect(batches[1]["DuplicateDatasets"]).To(Equal([]interface{}{opsmanagerDataset(batches[0]["Id"])}))
+
+		duplicates := getDuplicates()
+		Expect(duplicates).To(HaveLen(1))
+		Expect(duplicates[0]).To(HaveKeyWithValue("Id", batches[1]["Id"]))
+		Expect(duplicates[0]).To(HaveKeyWithValue("DuplicateOf", batches[0]["Id"]))
+		Expect(getMessages(serverUrl+"/received_batch_messages", validTokenContent)).To(HaveLen(2))
+	})
+
+	It("flags datasets that are resent in a different body", func() {
+		Expect(send(validTokenContent, true, generateTarFileContents("best-foundation-id", true))).To(Equal(http.StatusCreated))
+		Expect(send(validTokenContent, false, generateTarFileContents("best-foundation-id", false))).To(Equal(http.StatusCreated))
+
+		batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+		Expect(batches).To(HaveLen(2))
+		Expect(batches[1]).To(HaveKeyWithValue("Duplicate", true))
+		Expect(batches[1]).NotTo(HaveKey("DuplicateOf"))
+		Expect(batches[1]["DuplicateDatasets"]).To(Equal([]interface{}{opsmanagerDataset(batches[0]["Id"])}))
+	})
+
+	It("does not flag other collections or batches sent by other users", func() {
+		tarball := generateTarFileContents("best-foundation-id", true)
+		Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+		Expect(send(validTokenContent, true, generateTarFileContents("other-foundation-id", true))).To(Equal(http.StatusCreated))
+		Expect(send("Bearer second-token", true, tarball)).To(Equal(http.StatusCreated))
+
+		Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(HaveEach(HaveKeyWithValue("Duplicate", false)))
+		Expect(getMessages(serverUrl+"/received_batches", "Bearer second-token")).To(HaveEach(HaveKeyWithValue("Duplicate", false)))
+		Expect(getDuplicates()).To(BeEmpty())
+	})
+
+	It("counts duplicates in the metrics", func() {
+		tarball := generateTarFileContents("best-foundation-id", true)
+		for i := 0; i < 3; i++ {
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+		}
+
+		resp := makeRequest(http.MethodGet, serverUrl+"/metrics", "", nil)
+		defer func() { _ = resp.Body.Close() }()
+		metrics, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metrics)).To(ContainSubstring(`telemetry_receiver_duplicate_batches_total{user="user-id",outcome="flagged"} 2` + "\n"))
+	})
+
+	Context("with a message limit", func() {
+		BeforeEach(func() {
+			envs[MessageLimitEnvVar] = "1"
+		})
+
+		It("does not flag a batch whose original has been evicted", func() {
+			tarball := generateTarFileContents("best-foundation-id", true)
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+			Expect(send(validTokenContent, true, generateTarFileContents("other-foundation-id", true))).To(Equal(http.StatusCreated))
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+
+			batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+			Expect(batches).To(HaveLen(1))
+			Expect(batches[0]).To(HaveKeyWithValue("Sha256", sha256Hex(tarball)))
+			Expect(batches[0]).To(HaveKeyWithValue("Duplicate", false))
+		})
+	})
+
+	Context("when duplicates are rejected", func() {
+		BeforeEach(func() {
+			envs[DuplicateBatchesEnvVar] = "reject"
+		})
+
+		It("responds with 409 Conflict without storing the batch", func() {
+			tarball := generateTarFileContents("best-foundation-id", true)
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+			batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+			Expect(batches).To(HaveLen(1))
+
+			resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, tarball)
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+			var body map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+			Expect(body).To(HaveKeyWithValue("error", ContainSubstring("identical")))
+			Expect(body).To(HaveKeyWithValue("duplicate_of", batches[0]["Id"]))
+			Expect(body["duplicate_datasets"]).To(Equal([]interface{}{opsmanagerDataset(batches[0]["Id"])}))
+
+			Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(HaveLen(1))
+			Expect(getMessages(serverUrl+"/received_batch_messages", validTokenContent)).To(HaveLen(1))
+			Expect(getDuplicates()).To(BeEmpty())
+		})
+
+		It("accepts the batch again once the original is cleared", func() {
+			tarball := generateTarFileContents("best-foundation-id", true)
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+
+			resp := makeRequest(http.MethodPost, serverUrl+"/clear_messages", validTokenContent, nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("with a config file", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configPath = filepath.Join(GinkgoT().TempDir(), "config.yml")
+			Expect(os.WriteFile(configPath, []byte("{}"), 0600)).To(Succeed())
+			envs = map[string]string{ConfigFileEnvVar: configPath}
+		})
+
+		It("starts rejecting duplicates once reloaded", func() {
+			tarball := generateTarFileContents("best-foundation-id", true)
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusCreated))
+
+			Expect(os.WriteFile(configPath, []byte("duplicate_batches: reject\n"), 0600)).To(Succeed())
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("Reloaded config file"))
+
+			Expect(send(validTokenContent, true, tarball)).To(Equal(http.StatusConflict))
+		})
+	})
+
+	It("exits nonzero when the duplicate batch mode is invalid", func() {
+		session := startServerWithEnv(binaryPath, map[string]string{
+			PortEnvVar:             "0",
+			ApiKeysEnvVar:          `{"user-id": ["1234"]}`,
+			MessageLimitEnvVar:     "50",
+			DuplicateBatchesEnvVar: "drop",
+		})
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+		Expect(session.Out).To(gbytes.Say(InvalidDuplicateBatchesError + ": " + DuplicateBatchesEnvVar))
+	})
+})
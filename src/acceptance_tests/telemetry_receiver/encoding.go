@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingGzip     = "gzip"
+	encodingDeflate  = "deflate"
+	encodingZstd     = "zstd"
+	encodingIdentity = "identity"
+
+	// maxContentEncodings is the number of layers of compression a request body may have,
+	// which allows for clients that compress a .tar.gz again
+	maxContentEncodings = 3
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decodedBody is a request body with every layer of compression removed
+type decodedBody struct {
+	contents []byte
+	// declared is the Content-Encoding header the body was sent with
+	declared string
+	// detected lists the compression found from the body's magic bytes, outermost first as in
+	// a Content-Encoding header, or is identity when the body was not compressed
+	detected string
+}
+
+// decodeBody decompresses a request body by its Content-Encoding first, and then by the
+// magic bytes of any further layers of compression, as clients may leave the header out or
+// get it wrong. When the body cannot be decoded as declared, it is decoded by its magic bytes
+// alone, and when a layer found by its magic bytes cannot be decoded, the body is taken to
+// start with those bytes by chance and is kept as it was. Each layer is limited to
+// MAX_DECOMPRESSED_SIZE.
+func decodeBody(contents []byte, declared string) (decodedBody, error) {
+	var encodings []string
+	if declaredEncodings, ok := parseContentEncoding(declared); ok {
+		decoded, err := decompressLayers(declaredEncodings, contents)
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			return decodedBody{}, limitErr
+		}
+		if err == nil {
+			contents = decoded
+			encodings = declaredEncodings
+		}
+	}
+
+	for {
+		encoding := sniffEncoding(contents)
+		if encoding == "" {
+			break
+		}
+		if len(encodings) == maxContentEncodings {
+			return decodedBody{}, fmt.Errorf("request body is compressed more than %d times", maxContentEncodings)
+		}
+
+		decompressed, err := decompress(encoding, contents)
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			return decodedBody{}, limitErr
+		}
+		if err != nil {
+			break
+		}
+		contents = decompressed
+		encodings = append(encodings, encoding)
+	}
+
+	detected := encodingIdentity
+	if len(encodings) > 0 {
+		detected = strings.Join(encodings, ", ")
+	}
+	return decodedBody{contents: contents, declared: declared, detected: detected}, nil
+}
+
+// parseContentEncoding returns the compression a Content-Encoding header lists, outermost
+// first, and false when it lists none or one the receiver does not support
+func parseContentEncoding(header string) ([]string, bool) {
+	var encodings []string
+	for _, encoding := range strings.Split(header, ",") {
+		switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+		case "", encodingIdentity:
+		case encodingGzip, encodingDeflate, encodingZstd:
+			// The header lists the encodings in the order they were applied
+			encodings = append([]string{encoding}, encodings...)
+		default:
+			return nil, false
+		}
+	}
+	if len(encodings) == 0 || len(encodings) > maxContentEncodings {
+		return nil, false
+	}
+	return encodings, true
+}
+
+// decompressLayers removes the layers of compression, outermost first
+func decompressLayers(encodings []string, contents []byte) ([]byte, error) {
+	for _, encoding := range encodings {
+		decompressed, err := decompress(encoding, contents)
+		if err != nil {
+			return nil, err
+		}
+		contents = decompressed
+	}
+	return contents, nil
+}
+
+// sniffEncoding returns the compression the contents start with, if any. Deflate means the
+// zlib format, as it does in HTTP.
+func sniffEncoding(contents []byte) string {
+	switch {
+	case bytes.HasPrefix(contents, gzipMagic):
+		return encodingGzip
+	case bytes.HasPrefix(contents, zstdMagic):
+		return encodingZstd
+	case isZlibHeader(contents):
+		return encodingDeflate
+	default:
+		return ""
+	}
+}
+
+// isZlibHeader reports whether the contents start with an RFC 1950 header for the deflate
+// method without a preset dictionary. No JSON document starts like one, and a tarball only
+// does when its first file name starts with one of the few pairs of characters that pass
+// the header's checksum, such as "hC", in which case decodeBody keeps it as it was.
+func isZlibHeader(contents []byte) bool {
+	if len(contents) < 2 {
+		return false
+	}
+	cmf, flg := contents[0], contents[1]
+	return cmf&0x0f == 8 && cmf>>4 <= 7 && flg&0x20 == 0 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+func decompress(encoding string, contents []byte) ([]byte, error) {
+	var reader io.Reader
+	switch encoding {
+	case encodingGzip:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip contents: %w", err)
+		}
+		reader = gzipReader
+	case encodingDeflate:
+		zlibReader, err := zlib.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deflate contents: %w", err)
+		}
+		reader = zlibReader
+	case encodingZstd:
+		zstdReader, err := zstd.NewReader(bytes.NewReader(contents), zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(currentConfig().limits.decompressedSize)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd contents: %w", err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+
+	decompressed, err := io.ReadAll(newDecompressedSizeReader(reader))
+	// The zstd decoder also refuses frames whose window or declared size exceed its memory limit,
+	// before they are decompressed
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, decompressedSizeLimitError()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s contents: %w", encoding, err)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,200 @@
+package main_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Content encodings", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	send := func(path, contentEncoding string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, serverUrl+path, bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", validTokenContent)
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	DescribeTable("decompresses messages sent to /components",
+		func(contentEncoding string, compress func([]byte) []byte, expectedMetadata map[string]interface{}) {
+			resp := send("/components", contentEncoding, compress(generateTelemetryMsg()))
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			messages := getMessages(serverUrl+"/received_messages", validTokenContent)
+			Expect(messages).To(HaveLen(2))
+			Expect(messages[0]).To(HaveKeyWithValue("telemetry-source", "my-component"))
+
+			envelopes := getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)
+			Expect(envelopes).To(HaveLen(2))
+			Expect(envelopes[0]).To(HaveKeyWithValue("message", messages[0]))
+			Expect(envelopes[0]).To(HaveKeyWithValue("receiver", expectedMetadata))
+		},
+		Entry("gzip", "gzip", gzipContents, map[string]interface{}{
+			"ContentEncoding": "gzip", "DetectedContentEncoding": "gzip",
+		}),
+		Entry("deflate", "deflate", zlibContents, map[string]interface{}{
+			"ContentEncoding": "deflate", "DetectedContentEncoding": "deflate",
+		}),
+		Entry("zstd", "zstd", zstdContents, map[string]interface{}{
+			"ContentEncoding": "zstd", "DetectedContentEncoding": "zstd",
+		}),
+		Entry("gzip without a Content-Encoding", "", gzipContents, map[string]interface{}{
+			"DetectedContentEncoding": "gzip",
+		}),
+		Entry("zstd sent as gzip", "gzip", zstdContents, map[string]interface{}{
+			"ContentEncoding": "gzip", "DetectedContentEncoding": "zstd",
+		}),
+		Entry("uncompressed sent as gzip", "gzip", func(contents []byte) []byte { return contents }, map[string]interface{}{
+			"ContentEncoding": "gzip",
+		}),
+		Entry("uncompressed", "", func(contents []byte) []byte { return contents }, map[string]interface{}{}),
+	)
+
+	DescribeTable("decompresses tarballs sent to /collections/batch",
+		func(contentEncoding string, tarball []byte, detected string) {
+			resp := send("/collections/batch", contentEncoding, tarball)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			Expect(getMessages(serverUrl+"/received_batch_messages", validTokenContent)).To(ConsistOf(
+				HaveKeyWithValue("FoundationId", "best-foundation-id"),
+			))
+			batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+			Expect(batches).To(HaveLen(1))
+			Expect(batches[0]).To(HaveKeyWithValue("ContentEncoding", contentEncoding))
+			Expect(batches[0]).To(HaveKeyWithValue("DetectedContentEncoding", detected))
+
+			expectedMetadata := map[string]interface{}{}
+			if contentEncoding != "" {
+				expectedMetadata["ContentEncoding"] = contentEncoding
+			}
+			if detected != "identity" {
+				expectedMetadata["DetectedContentEncoding"] = detected
+			}
+			envelopes := getMessages(serverUrl+"/received_batch_messages?metadata=true", validTokenContent)
+			Expect(envelopes).To(HaveLen(1))
+			Expect(envelopes[0]).To(HaveKeyWithValue("receiver", expectedMetadata))
+		},
+		Entry("gzip", "gzip", generateTarFileContents("best-foundation-id", true), "gzip"),
+		Entry("deflate", "deflate", zlibContents(generateTarFileContents("best-foundation-id", false)), "deflate"),
+		Entry("zstd", "zstd", zstdContents(generateTarFileContents("best-foundation-id", false)), "zstd"),
+		Entry("gzip without a Content-Encoding", "", generateTarFileContents("best-foundation-id", true), "gzip"),
+		Entry("uncompressed sent as gzip", "gzip", generateTarFileContents("best-foundation-id", false), "identity"),
+		Entry("double compressed", "gzip", gzipContents(generateTarFileContents("best-foundation-id", true)), "gzip, gzip"),
+		Entry("zstd compressed .tar.gz", "zstd", zstdContents(generateTarFileContents("best-foundation-id", true)), "zstd, gzip"),
+		Entry("uncompressed starting like a deflate header", "", deflateLookalikeTar(), "identity"),
+		Entry("uncompressed starting like a deflate header sent as gzip", "gzip", deflateLookalikeTar(), "identity"),
+	)
+
+	It("serves a double compressed tarball with the encoding it was sent with", func() {
+		tarball := gzipContents(generateTarFileContents("best-foundation-id", true))
+		resp := send("/collections/batch", "gzip", tarball)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		batchID := getMessages(serverUrl+"/received_batches", validTokenContent)[0]["Id"].(string)
+
+		req, err := http.NewRequest(http.MethodGet, serverUrl+"/received_batches/"+batchID+"/archive", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", validTokenContent)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+		archive, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(archive).To(Equal(tarball))
+	})
+
+	It("rejects bodies compressed too many times", func() {
+		resp := send("/components", "gzip", gzipContents(gzipContents(gzipContents(gzipContents(generateTelemetryMsg())))))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("rejects truncated compressed bodies", func() {
+		compressed := zstdContents(generateTelemetryMsg())
+		resp := send("/components", "zstd", compressed[:len(compressed)-4])
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("with a decompressed size limit", func() {
+		BeforeEach(func() {
+			envs[MaxDecompressedSizeEnvVar] = "100000"
+		})
+
+		DescribeTable("rejects bodies that decompress to more than the limit",
+			func(path string, compress func([]byte) []byte) {
+				resp := send(path, "", compress(tarForContents(make([]byte, 10<<20), "opsmanager/data")))
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+
+				var body map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+				Expect(body).To(HaveKeyWithValue("limit", MaxDecompressedSizeEnvVar))
+			},
+			Entry("zstd to /collections/batch", "/collections/batch", zstdContents),
+			Entry("deflate to /components", "/components", zlibContents),
+		)
+	})
+})
+
+// deflateLookalikeTar returns a tarball whose first file name starts with characters that
+// pass the checksum of a zlib header
+func deflateLookalikeTar() []byte {
+	return tarForEntries(tarEntry{
+		Name:     "hC/metadata",
+		Contents: []byte(`{"FoundationId": "best-foundation-id", "CollectedAt": "2006-01-02T15:04:05Z07:00"}`),
+	})
+}
+
+func zlibContents(contents []byte) []byte {
+	buffer := &bytes.Buffer{}
+	writer := zlib.NewWriter(buffer)
+	_, err := writer.Write(contents)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(writer.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+func zstdContents(contents []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	Expect(err).NotTo(HaveOccurred())
+	defer func() { _ = encoder.Close() }()
+	return encoder.EncodeAll(contents, nil)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faultMatch selects the ingestion requests a fault rule applies to. Empty fields match every request.
+type faultMatch struct {
+	User            string `json:"user,omitempty"`
+	Path            string `json:"path,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// TarFilename matches tarballs with a file whose name contains it, e.g. "opsmanager/", as
+	// the collector does not send the name of the tarball itself
+	TarFilename string `json:"tar_filename,omitempty"`
+}
+
+// faultResponse replaces the normal response to a matching request. A zero Status
+// leaves the request to be handled normally after any added latency.
+type faultResponse struct {
+	Status  int               `json:"status,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type faultRule struct {
+	ID        string        `json:"id"`
+	Match     faultMatch    `json:"match"`
+	Response  faultResponse `json:"response"`
+	LatencyMs int           `json:"latency_ms,omitempty"`
+	// Remaining is the number of requests the rule still applies to, or zero if it applies indefinitely
+	Remaining int `json:"remaining,omitempty"`
+	Hits      int `json:"hits"`
+}
+
+func (f *faultRule) validate() error {
+	if f.Response.Status != 0 && (f.Response.Status < 100 || f.Response.Status > 599) {
+		return fmt.Errorf("response status %d is not a valid HTTP status code", f.Response.Status)
+	}
+	if f.LatencyMs < 0 {
+		return fmt.Errorf("latency_ms must not be negative")
+	}
+	if f.Remaining < 0 {
+		return fmt.Errorf("remaining must not be negative")
+	}
+	if f.Response.Status == 0 && f.LatencyMs == 0 {
+		return fmt.Errorf("rule must set a response status or latency_ms")
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the request. entryNames returns the names of the
+// files in the request's tarball, and is only called for rules that match on them.
+func (f *faultRule) matches(userID string, r *http.Request, entryNames func() []string) bool {
+	if f.Match.User != "" && f.Match.User != userID {
+		return false
+	}
+	if f.Match.Path != "" && f.Match.Path != r.URL.Path {
+		return false
+	}
+	if f.Match.ContentEncoding != "" && f.Match.ContentEncoding != r.Header.Get("Content-Encoding") {
+		return false
+	}
+	if f.Match.TarFilename != "" && !slices.ContainsFunc(entryNames(), func(name string) bool {
+		return strings.Contains(name, f.Match.TarFilename)
+	}) {
+		return false
+	}
+	return true
+}
+
+// tarEntryNames returns the names of the regular files in a request body holding a tarball,
+// as far as it can be read
+func tarEntryNames(contents []byte, contentEncoding string) []string {
+	body, err := decodeBody(contents, contentEncoding)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	tarReader := tar.NewReader(bytes.NewReader(body.contents))
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			return names
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+}
+
+// faultInjector holds the fault rules installed through the admin API, in the order they were installed
+type faultInjector struct {
+	mu     sync.Mutex
+	rules  []*faultRule
+	nextID int
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{}
+}
+
+func (fi *faultInjector) add(rule faultRule) faultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.nextID++
+	rule.ID = strconv.Itoa(fi.nextID)
+	rule.Hits = 0
+	fi.rules = append(fi.rules, &rule)
+	return rule
+}
+
+// ownedBy reports whether the rule belongs to the user, or to anyone for an empty user
+func (f *faultRule) ownedBy(userID string) bool {
+	return userID == "" || f.Match.User == userID
+}
+
+// list returns the rules matching the user's requests, or every rule for an empty user
+func (fi *faultInjector) list(userID string) []faultRule {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	rules := make([]faultRule, 0, len(fi.rules))
+	for _, rule := range fi.rules {
+		if rule.ownedBy(userID) {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules
+}
+
+// remove removes the rule with the id if it belongs to the user, or to anyone for an empty user
+func (fi *faultInjector) remove(id, userID string) bool {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	for i, rule := range fi.rules {
+		if rule.ID == id && rule.ownedBy(userID) {
+			fi.rules = append(fi.rules[:i], fi.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// clear removes the rules matching the user's requests, or every rule for an empty user
+func (fi *faultInjector) clear(userID string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.rules = slices.DeleteFunc(fi.rules, func(rule *faultRule) bool {
+		return rule.ownedBy(userID)
+	})
+}
+
+// match returns a copy of the first rule matching the request and its body, consuming one
+// of its remaining uses and removing it once none are left
+func (fi *faultInjector) match(userID string, r *http.Request, body []byte) (faultRule, bool) {
+	entryNames := sync.OnceValue(func() []string {
+		return tarEntryNames(body, r.Header.Get("Content-Encoding"))
+	})
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	for i, rule := range fi.rules {
+		if !rule.matches(userID, r, entryNames) {
+			continue
+		}
+
+		rule.Hits++
+		if rule.Remaining > 0 {
+			rule.Remaining--
+			if rule.Remaining == 0 {
+				fi.rules = append(fi.rules[:i], fi.rules[i+1:]...)
+			}
+		}
+		return *rule, true
+	}
+	return faultRule{}, false
+}
+
+// injectFault applies the first fault rule matching the request and its body. It returns true
+// when the rule's response has been written and the request must not be handled further.
+func injectFault(w http.ResponseWriter, r *http.Request, userID string, body []byte) bool {
+	rule, ok := faults.match(userID, r, body)
+	if !ok {
+		return false
+	}
+
+	log.Printf("Applying fault rule %s to %s request for user %s", rule.ID, r.URL.Path, userID)
+	if rule.LatencyMs > 0 {
+		select {
+		case <-time.After(time.Duration(rule.LatencyMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+
+	if rule.Response.Status == 0 {
+		return false
+	}
+
+	for name, value := range rule.Response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(rule.Response.Status)
+	if _, err := w.Write([]byte(rule.Response.Body)); err != nil {
+		log.Printf("Error writing fault rule %s response for user %s: %v", rule.ID, userID, err)
+	}
+	return true
+}
+
+// addFaultRule installs a fault rule. A key with the admin scope may only install rules for
+// its own user's requests, so its rules match that user whether or not they say so.
+func addFaultRule(w http.ResponseWriter, r *http.Request) {
+	adminUserID, ok := adminAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	var rule faultRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid fault rule: %v", err))
+		return
+	}
+	if adminUserID != "" {
+		if rule.Match.User != "" && rule.Match.User != adminUserID {
+			otherUser(adminUserID).write(w)
+			return
+		}
+		rule.Match.User = adminUserID
+	}
+	if err := rule.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid fault rule: %v", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, faults.add(rule))
+}
+
+func listFaultRules(w http.ResponseWriter, r *http.Request) {
+	adminUserID, ok := adminAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, faults.list(adminUserID))
+}
+
+func deleteFaultRule(w http.ResponseWriter, r *http.Request) {
+	adminUserID, ok := adminAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	if !faults.remove(r.PathValue("id"), adminUserID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteFaultRules(w http.ResponseWriter, r *http.Request) {
+	adminUserID, ok := adminAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	faults.clear(adminUserID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,167 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Fault injection", func() {
+	const adminTokenContent = "Bearer admin-token"
+
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	addRule := func(rule string) map[string]interface{} {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/faults", adminTokenContent, []byte(rule))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		var created map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&created)).To(Succeed())
+		return created
+	}
+
+	sendTarball := func(authHeaderContent, dataset string) *http.Response {
+		tarball := gzipContents(tarForEntries(tarEntry{
+			Name:     path.Join(dataset, "metadata"),
+			Contents: []byte(`{"FoundationId": "best-foundation-id", "CollectedAt": "2006-01-02T15:04:05Z07:00"}`),
+		}))
+		req, err := http.NewRequest(http.MethodPost, serverUrl+"/collections/batch", bytes.NewReader(tarball))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", authHeaderContent)
+		req.Header.Set("Content-Type", "application/tar")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{AdminApiKeyEnvVar: "admin-token"})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("responds with the rule's response for the next N matching requests", func() {
+		addRule(`{
+			"match": {"path": "/collections/batch", "tar_filename": "usage_service/"},
+			"response": {"status": 503, "body": "upstream unavailable", "headers": {"Retry-After": "5"}},
+			"remaining": 2
+		}`)
+
+		for i := 0; i < 2; i++ {
+			resp := sendTarball(validTokenContent, "usage_service")
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("5"))
+			Expect(string(body)).To(Equal("upstream unavailable"))
+
+			resp = sendTarball(validTokenContent, "opsmanager")
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		}
+
+		resp := sendTarball(validTokenContent, "usage_service")
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		Expect(getMessages(serverUrl+"/received_batch_messages", validTokenContent)).To(HaveLen(3))
+		Expect(getMessages(serverUrl+"/admin/faults", adminTokenContent)).To(BeEmpty())
+	})
+
+	It("only applies rules to requests from the matching user and content encoding", func() {
+		addRule(`{"match": {"user": "user-id2", "content_encoding": "gzip"}, "response": {"status": 401}}`)
+
+		resp := sendTarball(validTokenContent, "opsmanager")
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", "Bearer second-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = sendTarball("Bearer second-token", "opsmanager")
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		rules := getMessages(serverUrl+"/admin/faults", adminTokenContent)
+		Expect(rules).To(HaveLen(1))
+		Expect(rules[0]["hits"]).To(Equal(float64(1)))
+	})
+
+	It("delays matching requests before handling them normally when the rule only adds latency", func() {
+		addRule(`{"match": {"path": "/components"}, "latency_ms": 300}`)
+
+		start := time.Now()
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+	})
+
+	It("allows rules to be listed and removed", func() {
+		first := addRule(`{"response": {"status": 500}}`)
+		addRule(`{"response": {"status": 502}}`)
+		Expect(getMessages(serverUrl+"/admin/faults", adminTokenContent)).To(HaveLen(2))
+
+		resp := makeRequest(http.MethodDelete, serverUrl+"/admin/faults/"+first["id"].(string), adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+
+		resp = makeRequest(http.MethodDelete, serverUrl+"/admin/faults/"+first["id"].(string), adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+		resp = makeRequest(http.MethodDelete, serverUrl+"/admin/faults", adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(getMessages(serverUrl+"/admin/faults", adminTokenContent)).To(BeEmpty())
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+	})
+
+	It("rejects invalid rules", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/faults", adminTokenContent, []byte(`{"response": {"status": 42}}`))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		var body map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body["error"]).To(ContainSubstring("not a valid HTTP status code"))
+	})
+
+	It("requires the admin api key", func() {
+		resp := makeRequest(http.MethodGet, serverUrl+"/admin/faults", validTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/admin/faults", "", []byte(`{"response": {"status": 500}}`))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// eventTimeExtID is the msgpack extension type fluentd's forward protocol uses for EventTime
+	eventTimeExtID = 0
+
+	defaultForwardHostname  = "telemetry-receiver"
+	forwardHandshakeTimeout = 10 * time.Second
+)
+
+func init() {
+	msgpack.RegisterExt(eventTimeExtID, (*eventTime)(nil))
+}
+
+// eventTime is the forward protocol's nanosecond precision timestamp
+type eventTime struct {
+	time.Time
+}
+
+func (t *eventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+func (t *eventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid EventTime length %d", len(b))
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	return nil
+}
+
+// forwardServer accepts connections from fluentd/fluent-bit forward outputs and stores
+// every record they send in the messages collection for the forward user. Like the
+// centralizer's forward input, it can require TLS, client certificates and a shared key.
+type forwardServer struct {
+	userID    string
+	tlsConfig *tls.Config
+	// sharedKey enables the forward protocol's HELO/PING/PONG handshake when set
+	sharedKey string
+	hostname  string
+
+	// mu protects listener and conns, which are closed on shutdown
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	// handlers tracks connection handlers so shutdown can wait for them to finish storing messages
+	handlers sync.WaitGroup
+}
+
+func newForwardServerFromConfig(source configSource) (*forwardServer, error) {
+	server := &forwardServer{
+		userID:    source.get(ForwardUserIDEnvVar),
+		sharedKey: source.get(ForwardSharedKeyEnvVar),
+		hostname:  source.get(ForwardHostnameEnvVar),
+		conns:     map[net.Conn]struct{}{},
+	}
+	if server.hostname == "" {
+		server.hostname = defaultForwardHostname
+	}
+
+	certPath := source.get(ForwardTLSCertPathEnvVar)
+	keyPath := source.get(ForwardTLSKeyPathEnvVar)
+	caPath := source.get(ForwardTLSCAPathEnvVar)
+	if certPath == "" && keyPath == "" {
+		if caPath != "" {
+			return nil, fmt.Errorf("%s requires %s and %s", ForwardTLSCAPathEnvVar, ForwardTLSCertPathEnvVar, ForwardTLSKeyPathEnvVar)
+		}
+		return server, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load forward TLS certificate: %w", err)
+	}
+	server.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		// Matches the centralizer's ECDHE+AESGCM ciphers; TLS 1.3 suites are not configurable
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+	}
+
+	if caPath != "" {
+		caCert, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read forward TLS CA certificate: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+		server.tlsConfig.ClientCAs = clientCAs
+		server.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return server, nil
+}
+
+func (s *forwardServer) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	return listener, nil
+}
+
+func (s *forwardServer) serve(listener net.Listener) {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting forward connection: %v", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.handlers.Done()
+			s.handleConnection(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// close stops accepting connections and closes the open ones, then waits for their
+// handlers to finish storing the messages they already read. Clients resend any
+// chunk that was not acknowledged.
+func (s *forwardServer) close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("forward connections still open: %w", ctx.Err())
+	}
+}
+
+func (s *forwardServer) handleConnection(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	var clientSubject string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		_ = tlsConn.SetDeadline(time.Now().Add(forwardHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("Error completing forward TLS handshake with %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+
+		if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) > 0 {
+			clientSubject = peerCerts[0].Subject.String()
+		}
+	}
+
+	decoder := msgpack.NewDecoder(conn)
+	encoder := msgpack.NewEncoder(conn)
+
+	if s.sharedKey != "" {
+		if err := s.authenticate(conn, decoder, encoder); err != nil {
+			log.Printf("Error authenticating forward connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	for {
+		msg, err := decoder.DecodeInterface()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading forward message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		records, option, err := readForwardMessage(msg)
+		if err != nil {
+			log.Printf("Error parsing forward message from %s: %v", conn.RemoteAddr(), err)
+			metrics.parseFailures.inc(s.userID, forwardEndpoint)
+			return
+		}
+		if err := storeForwardRecords(s.userID, records, clientSubject); err != nil {
+			// Without an ack the client will resend the chunk
+			log.Printf("Error storing forward messages for user %s: %v", s.userID, err)
+			continue
+		}
+
+		if chunk, ok := option["chunk"].(string); ok && chunk != "" {
+			if err := encoder.Encode(map[string]string{"ack": chunk}); err != nil {
+				log.Printf("Error acknowledging forward chunk from %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// authenticate performs the forward protocol's shared key handshake: the server sends
+// HELO with a nonce, the client proves it knows the shared key in PING, and the server
+// proves the same in PONG
+func (s *forwardServer) authenticate(conn net.Conn, decoder *msgpack.Decoder, encoder *msgpack.Encoder) error {
+	_ = conn.SetDeadline(time.Now().Add(forwardHandshakeTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	// No user authentication is supported, which is signalled by an empty auth salt
+	helo := []interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": "", "keepalive": true}}
+	if err := encoder.Encode(helo); err != nil {
+		return fmt.Errorf("failed to send HELO: %w", err)
+	}
+
+	msg, err := decoder.DecodeInterface()
+	if err != nil {
+		return fmt.Errorf("failed to read PING: %w", err)
+	}
+	ping, ok := msg.([]interface{})
+	if !ok || len(ping) < 4 || ping[0] != "PING" {
+		return errors.New("expected PING message")
+	}
+	clientHostname, ok := ping[1].(string)
+	if !ok {
+		return errors.New("PING client hostname must be a string")
+	}
+	sharedKeySalt, ok := stringOrBytes(ping[2])
+	if !ok {
+		return errors.New("PING shared key salt must be a string")
+	}
+	clientDigest, ok := ping[3].(string)
+	if !ok {
+		return errors.New("PING shared key digest must be a string")
+	}
+
+	expectedDigest := sharedKeyDigest(sharedKeySalt, clientHostname, nonce, s.sharedKey)
+	if subtle.ConstantTimeCompare([]byte(clientDigest), []byte(expectedDigest)) != 1 {
+		pong := []interface{}{"PONG", false, "shared_key mismatch", s.hostname, ""}
+		if err := encoder.Encode(pong); err != nil {
+			return fmt.Errorf("failed to send PONG: %w", err)
+		}
+		return fmt.Errorf("shared key mismatch for client %s", clientHostname)
+	}
+
+	pong := []interface{}{"PONG", true, "", s.hostname, sharedKeyDigest(sharedKeySalt, s.hostname, nonce, s.sharedKey)}
+	if err := encoder.Encode(pong); err != nil {
+		return fmt.Errorf("failed to send PONG: %w", err)
+	}
+	return nil
+}
+
+func sharedKeyDigest(salt []byte, hostname string, nonce []byte, sharedKey string) string {
+	digest := sha512.New()
+	digest.Write(salt)
+	digest.Write([]byte(hostname))
+	digest.Write(nonce)
+	digest.Write([]byte(sharedKey))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// forwardRecord is a record decoded from a forward message along with the tag and time it was sent with
+type forwardRecord struct {
+	message map[string]interface{}
+	tag     string
+	time    time.Time
+}
+
+// storeForwardRecords stores records as they were sent, with their tag and time and the subject of
+// the client's certificate as receiver metadata. Records sent at the same time share one append.
+func storeForwardRecords(userID string, records []forwardRecord, clientSubject string) error {
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].tag == records[start].tag && records[end].time.Equal(records[start].time) {
+			end++
+		}
+
+		messages := make([]map[string]interface{}, 0, end-start)
+		for _, record := range records[start:end] {
+			messages = append(messages, record.message)
+		}
+		metadata := &receiverMetadata{
+			ForwardTag:           records[start].tag,
+			ForwardTime:          records[start].time.UTC().Format(time.RFC3339Nano),
+			ForwardClientSubject: clientSubject,
+		}
+		if err := updateMessages(userID, collectionMessages{messagesCollection: messages}, metadata); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// readForwardMessage decodes a Message, Forward, PackedForward or CompressedPackedForward
+// mode message into records and returns them along with the message's options
+func readForwardMessage(msg interface{}) ([]forwardRecord, map[string]interface{}, error) {
+	fields, ok := msg.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, nil, errors.New("forward message must be an array of at least two elements")
+	}
+	tag, ok := fields[0].(string)
+	if !ok {
+		return nil, nil, errors.New("forward message tag must be a string")
+	}
+
+	var entries []interface{}
+	var option map[string]interface{}
+	switch events := fields[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		entries = events
+		option, ok = optionAt(fields, 2)
+	case string, []byte:
+		// PackedForward and CompressedPackedForward modes: [tag, msgpack stream of [time, record], option]
+		option, ok = optionAt(fields, 2)
+		if !ok {
+			break
+		}
+		var err error
+		packed, _ := stringOrBytes(events)
+		entries, err = unpackForwardEntries(packed, option["compressed"])
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(fields) < 3 {
+			return nil, nil, errors.New("forward message in message mode must include a record")
+		}
+		entries = []interface{}{fields[1:3]}
+		option, ok = optionAt(fields, 3)
+	}
+	if !ok {
+		return nil, nil, errors.New("forward message option must be a map")
+	}
+
+	records := make([]forwardRecord, 0, len(entries))
+	for _, entry := range entries {
+		record, err := readForwardEntry(tag, entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, record)
+	}
+	return records, option, nil
+}
+
+func optionAt(fields []interface{}, i int) (map[string]interface{}, bool) {
+	if len(fields) <= i || fields[i] == nil {
+		return map[string]interface{}{}, true
+	}
+	option, ok := fields[i].(map[string]interface{})
+	return option, ok
+}
+
+func unpackForwardEntries(packed []byte, compressed interface{}) ([]interface{}, error) {
+	var reader io.Reader = bytes.NewReader(packed)
+	switch compressed {
+	case nil, "", "text":
+	case "gzip":
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip forward entries: %w", err)
+		}
+		reader = newDecompressedSizeReader(gzipReader)
+	default:
+		return nil, fmt.Errorf("unsupported forward compression %v", compressed)
+	}
+
+	var entries []interface{}
+	decoder := msgpack.NewDecoder(reader)
+	for {
+		entry, err := decoder.DecodeInterface()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read packed forward entries: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// readForwardEntry converts a [time, record] entry into a record to store, along
+// with the tag and time it was sent with
+func readForwardEntry(tag string, entry interface{}) (forwardRecord, error) {
+	fields, ok := entry.([]interface{})
+	if !ok || len(fields) != 2 {
+		return forwardRecord{}, errors.New("forward entry must be a [time, record] array")
+	}
+
+	eventTime, err := forwardTime(fields[0])
+	if err != nil {
+		return forwardRecord{}, err
+	}
+	record, ok := fields[1].(map[string]interface{})
+	if !ok {
+		return forwardRecord{}, errors.New("forward entry record must be a map")
+	}
+
+	message := jsonCompatible(record).(map[string]interface{})
+	return forwardRecord{message: message, tag: tag, time: eventTime}, nil
+}
+
+func forwardTime(value interface{}) (time.Time, error) {
+	switch t := value.(type) {
+	case *eventTime:
+		return t.Time, nil
+	case float32:
+		return time.Unix(0, int64(float64(t)*float64(time.Second))), nil
+	case float64:
+		return time.Unix(0, int64(t*float64(time.Second))), nil
+	}
+	if seconds, ok := toInt64(value); ok {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported forward event time %v", value)
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch i := value.(type) {
+	case int8:
+		return int64(i), true
+	case int16:
+		return int64(i), true
+	case int32:
+		return int64(i), true
+	case int64:
+		return i, true
+	case uint8:
+		return int64(i), true
+	case uint16:
+		return int64(i), true
+	case uint32:
+		return int64(i), true
+	case uint64:
+		return int64(i), true
+	}
+	return 0, false
+}
+
+func stringOrBytes(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	}
+	return nil, false
+}
+
+// jsonCompatible converts decoded msgpack values into values that marshal to JSON
+// the same way the centralizer would forward them, e.g. bin values as strings
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			converted[key] = jsonCompatible(val)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, val := range v {
+			converted[i] = jsonCompatible(val)
+		}
+		return converted
+	case []byte:
+		return string(v)
+	case *eventTime:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
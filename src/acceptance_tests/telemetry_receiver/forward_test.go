@@ -0,0 +1,446 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var _ = Describe("Forward listener", func() {
+	var (
+		session     *gexec.Session
+		serverUrl   string
+		forwardAddr string
+		conn        net.Conn
+		encoder     *msgpack.Encoder
+		decoder     *msgpack.Decoder
+	)
+
+	eventTime := time.Date(2009, 11, 10, 23, 0, 0, 123456789, time.UTC)
+	record := map[string]interface{}{
+		"log":           `{"telemetry-source": "my-component", "telemetry-time": "2009-11-10T23:00:00Z"}`,
+		"agent-version": "0.0.2",
+	}
+	expectedMessage := map[string]interface{}{
+		"message": record,
+		"receiver": map[string]interface{}{
+			"ForwardTag":  "telemetry.agent",
+			"ForwardTime": "2009-11-10T23:00:00.123456789Z",
+		},
+	}
+
+	packEntries := func(entries ...[]interface{}) []byte {
+		buffer := &bytes.Buffer{}
+		packer := msgpack.NewEncoder(buffer)
+		for _, entry := range entries {
+			Expect(packer.Encode(entry)).To(Succeed())
+		}
+		return buffer.Bytes()
+	}
+
+	expectAck := func(chunk string) {
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		ack, err := decoder.DecodeMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ack).To(Equal(map[string]interface{}{"ack": chunk}))
+	}
+
+	BeforeEach(func() {
+		forwardPort, err := findFreePort()
+		Expect(err).NotTo(HaveOccurred())
+		session, serverUrl = startServerAndWait(map[string]string{
+			ForwardPortEnvVar:   forwardPort,
+			ForwardUserIDEnvVar: "user-id",
+		})
+		Expect(dialLoader(forwardPort)).To(BeTrue())
+
+		forwardAddr = "127.0.0.1:" + forwardPort
+		conn, err = net.Dial("tcp", forwardAddr)
+		Expect(err).NotTo(HaveOccurred())
+		encoder = msgpack.NewEncoder(conn)
+		decoder = msgpack.NewDecoder(conn)
+	})
+
+	AfterEach(func() {
+		_ = conn.Close()
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("stores records sent in message mode for the forward user", func() {
+		Expect(encoder.Encode([]interface{}{
+			"telemetry.agent", &testEventTime{eventTime}, record, map[string]interface{}{"chunk": "chunk-1"},
+		})).To(Succeed())
+		expectAck("chunk-1")
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(Equal([]map[string]interface{}{record}))
+		Expect(getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)).To(Equal([]map[string]interface{}{expectedMessage}))
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer second-token")).To(BeEmpty())
+	})
+
+	It("stores records sent in forward mode", func() {
+		Expect(encoder.Encode([]interface{}{
+			"telemetry.agent",
+			[]interface{}{
+				[]interface{}{&testEventTime{eventTime}, record},
+				[]interface{}{eventTime.Unix(), map[string]interface{}{"log": "second"}},
+			},
+			map[string]interface{}{"chunk": "chunk-2", "size": 2},
+		})).To(Succeed())
+		expectAck("chunk-2")
+
+		Expect(getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)).To(Equal([]map[string]interface{}{
+			expectedMessage,
+			{
+				"message":  map[string]interface{}{"log": "second"},
+				"receiver": map[string]interface{}{"ForwardTag": "telemetry.agent", "ForwardTime": "2009-11-10T23:00:00Z"},
+			},
+		}))
+	})
+
+	It("stores records sent in packed forward mode", func() {
+		Expect(encoder.Encode([]interface{}{
+			"telemetry.agent",
+			packEntries(
+				[]interface{}{&testEventTime{eventTime}, record},
+				[]interface{}{&testEventTime{eventTime}, record},
+			),
+		})).To(Succeed())
+
+		Eventually(func() []map[string]interface{} {
+			return getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)
+		}).Should(Equal([]map[string]interface{}{expectedMessage, expectedMessage}))
+	})
+
+	It("stores records sent in compressed packed forward mode", func() {
+		Expect(encoder.Encode([]interface{}{
+			"telemetry.agent",
+			gzipContents(packEntries([]interface{}{&testEventTime{eventTime}, record})),
+			map[string]interface{}{"compressed": "gzip", "chunk": "chunk-3"},
+		})).To(Succeed())
+		expectAck("chunk-3")
+
+		Expect(getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)).To(Equal([]map[string]interface{}{expectedMessage}))
+	})
+
+	It("closes the connection when it receives an invalid message", func() {
+		Expect(encoder.Encode(map[string]interface{}{"not": "an array"})).To(Succeed())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		_, err := decoder.DecodeInterface()
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(MatchError(ContainSubstring("timeout")))
+	})
+
+	It("when the forward user is not configured, it exits nonzero", func() {
+		errorSession := startServer(binaryPath, "2020", map[string]string{
+			ForwardPortEnvVar:   "2021",
+			ForwardUserIDEnvVar: "unknown-user",
+		})
+		Eventually(errorSession).Should(gexec.Exit(1))
+		Expect(errorSession.Out).To(gbytes.Say(InvalidForwardConfigError))
+	})
+})
+
+var _ = Describe("Forward listener security", func() {
+	var (
+		session     *gexec.Session
+		serverUrl   string
+		forwardAddr string
+		certs       forwardCerts
+		env         map[string]string
+	)
+
+	record := map[string]interface{}{"log": "hello"}
+
+	startForwardServer := func() {
+		forwardPort, err := findFreePort()
+		Expect(err).NotTo(HaveOccurred())
+		env[ForwardPortEnvVar] = forwardPort
+		env[ForwardUserIDEnvVar] = "user-id"
+		session, serverUrl = startServerAndWait(env)
+		Expect(dialLoader(forwardPort)).To(BeTrue())
+		forwardAddr = "127.0.0.1:" + forwardPort
+	}
+
+	dialTLS := func(clientCert *tls.Certificate, maxVersion uint16) (*tls.Conn, error) {
+		config := &tls.Config{
+			RootCAs:    certs.caPool,
+			ServerName: "127.0.0.1",
+			MaxVersion: maxVersion,
+		}
+		if clientCert != nil {
+			config.Certificates = []tls.Certificate{*clientCert}
+		}
+		return tls.Dial("tcp", forwardAddr, config)
+	}
+
+	sendAndAck := func(conn net.Conn, decoder *msgpack.Decoder) {
+		Expect(msgpack.NewEncoder(conn).Encode([]interface{}{
+			"telemetry.agent", time.Now().Unix(), record, map[string]interface{}{"chunk": "chunk-1"},
+		})).To(Succeed())
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		ack, err := decoder.DecodeMap()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ack).To(Equal(map[string]interface{}{"ack": "chunk-1"}))
+	}
+
+	BeforeEach(func() {
+		session = nil
+		certs = generateForwardCerts(GinkgoT().TempDir())
+		env = map[string]string{
+			ForwardTLSCertPathEnvVar: certs.serverCertPath,
+			ForwardTLSKeyPathEnvVar:  certs.serverKeyPath,
+			ForwardTLSCAPathEnvVar:   certs.caPath,
+		}
+	})
+
+	AfterEach(func() {
+		if session != nil {
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+		}
+	})
+
+	Context("with mutual TLS", func() {
+		BeforeEach(func() {
+			startForwardServer()
+		})
+
+		It("records the client certificate subject on every stored record", func() {
+			conn, err := dialTLS(&certs.clientCert, 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			sendAndAck(conn, msgpack.NewDecoder(conn))
+
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(Equal([]map[string]interface{}{record}))
+			Expect(getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)).To(ConsistOf(
+				HaveKeyWithValue("receiver", HaveKeyWithValue("ForwardClientSubject", "CN=telemetry-agent,O=Telemetry Acceptance")),
+			))
+		})
+
+		It("rejects clients without a certificate signed by the CA", func() {
+			// With TLS 1.3 the server rejects client certificates after the client's
+			// side of the handshake completes, so the rejection surfaces on first read
+			conn, err := dialTLS(nil, 0)
+			if err == nil {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = msgpack.NewDecoder(conn).DecodeInterface()
+				_ = conn.Close()
+			}
+			Expect(err).To(HaveOccurred())
+
+			conn, err = dialTLS(&certs.untrustedClientCert, 0)
+			if err == nil {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err = msgpack.NewDecoder(conn).DecodeInterface()
+				_ = conn.Close()
+			}
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects clients that do not support TLS 1.2 or later", func() {
+			_, err := dialTLS(&certs.clientCert, tls.VersionTLS11)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a shared key", func() {
+		BeforeEach(func() {
+			env[ForwardSharedKeyEnvVar] = "shared-secret"
+			env[ForwardHostnameEnvVar] = "receiver-host"
+			startForwardServer()
+		})
+
+		handshake := func(conn net.Conn, decoder *msgpack.Decoder, sharedKey string) []interface{} {
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			helo, err := decoder.DecodeSlice()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(helo[0]).To(Equal("HELO"))
+			options, ok := helo[1].(map[string]interface{})
+			Expect(ok).To(BeTrue())
+			nonce, ok := options["nonce"].([]byte)
+			Expect(ok).To(BeTrue())
+			Expect(options["keepalive"]).To(BeTrue())
+
+			salt := []byte("client-salt")
+			Expect(msgpack.NewEncoder(conn).Encode([]interface{}{
+				"PING", "agent-host", salt, testSharedKeyDigest(salt, "agent-host", nonce, sharedKey), "", "",
+			})).To(Succeed())
+
+			pong, err := decoder.DecodeSlice()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pong).To(HaveLen(5))
+			Expect(pong[0]).To(Equal("PONG"))
+			if pong[1] == true {
+				Expect(pong[3]).To(Equal("receiver-host"))
+				Expect(pong[4]).To(Equal(testSharedKeyDigest(salt, "receiver-host", nonce, sharedKey)))
+			}
+			return pong
+		}
+
+		It("accepts records after a successful handshake", func() {
+			conn, err := dialTLS(&certs.clientCert, 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+			decoder := msgpack.NewDecoder(conn)
+
+			pong := handshake(conn, decoder, "shared-secret")
+			Expect(pong[1]).To(BeTrue())
+
+			sendAndAck(conn, decoder)
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(1))
+		})
+
+		It("rejects clients using a different shared key", func() {
+			conn, err := dialTLS(&certs.clientCert, 0)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+			decoder := msgpack.NewDecoder(conn)
+
+			pong := handshake(conn, decoder, "wrong-secret")
+			Expect(pong[1]).To(BeFalse())
+			Expect(pong[2]).To(Equal("shared_key mismatch"))
+
+			_, err = decoder.DecodeInterface()
+			Expect(err).To(HaveOccurred())
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+		})
+	})
+
+	It("when the TLS certificate cannot be loaded, it exits nonzero", func() {
+		errorSession := startServer(binaryPath, "2020", map[string]string{
+			ForwardPortEnvVar:        "2021",
+			ForwardUserIDEnvVar:      "user-id",
+			ForwardTLSCertPathEnvVar: "/does/not/exist.pem",
+			ForwardTLSKeyPathEnvVar:  "/does/not/exist.pem",
+		})
+		Eventually(errorSession).Should(gexec.Exit(1))
+		Expect(errorSession.Out).To(gbytes.Say(InvalidForwardConfigError))
+	})
+})
+
+type forwardCerts struct {
+	caPath              string
+	caPool              *x509.CertPool
+	serverCertPath      string
+	serverKeyPath       string
+	clientCert          tls.Certificate
+	untrustedClientCert tls.Certificate
+}
+
+// generateForwardCerts writes a CA and a server certificate for 127.0.0.1 to dir,
+// and returns client certificates signed by the CA and by an untrusted CA
+func generateForwardCerts(dir string) forwardCerts {
+	ca, caKey := generateCert(nil, nil, "Telemetry Acceptance CA", true)
+	serverCert, serverKey := generateCert(ca, caKey, "127.0.0.1", false)
+	clientCert, clientKey := generateCert(ca, caKey, "telemetry-agent", false)
+	otherCA, otherCAKey := generateCert(nil, nil, "Other CA", true)
+	untrustedCert, untrustedKey := generateCert(otherCA, otherCAKey, "telemetry-agent", false)
+
+	certs := forwardCerts{
+		caPath:         filepath.Join(dir, "ca_cert.pem"),
+		caPool:         x509.NewCertPool(),
+		serverCertPath: filepath.Join(dir, "cert.pem"),
+		serverKeyPath:  filepath.Join(dir, "private_key.pem"),
+		clientCert: tls.Certificate{
+			Certificate: [][]byte{clientCert.Raw},
+			PrivateKey:  clientKey,
+		},
+		untrustedClientCert: tls.Certificate{
+			Certificate: [][]byte{untrustedCert.Raw},
+			PrivateKey:  untrustedKey,
+		},
+	}
+	certs.caPool.AddCert(ca)
+
+	serverKeyBytes, err := x509.MarshalECPrivateKey(serverKey)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(os.WriteFile(certs.caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)).To(Succeed())
+	Expect(os.WriteFile(certs.serverCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Raw}), 0600)).To(Succeed())
+	Expect(os.WriteFile(certs.serverKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: serverKeyBytes}), 0600)).To(Succeed())
+	return certs
+}
+
+func generateCert(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, commonName string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Telemetry Acceptance"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(commonName); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return cert, key
+}
+
+func testSharedKeyDigest(salt []byte, hostname string, nonce []byte, sharedKey string) string {
+	digest := sha512.New()
+	digest.Write(salt)
+	digest.Write([]byte(hostname))
+	digest.Write(nonce)
+	digest.Write([]byte(sharedKey))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// testEventTime encodes the forward protocol's EventTime extension type
+type testEventTime struct {
+	time.Time
+}
+
+func init() {
+	msgpack.RegisterExt(0, (*testEventTime)(nil))
+}
+
+func (t *testEventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+func (t *testEventTime) UnmarshalMsgpack(b []byte) error {
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	return nil
+}
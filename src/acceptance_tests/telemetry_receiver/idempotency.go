@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader lets a client retry a POST to an ingestion endpoint without its
+	// messages being stored twice
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a repeated Idempotency-Key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotencyKeyLength  = 255
+	// maxIdempotencyKeysPerUser is the number of responses cached for each user, beyond which
+	// the oldest is forgotten
+	maxIdempotencyKeysPerUser = 1000
+	// inFlightRetryAfter is the Retry-After, in seconds, of a repeat sent while the first
+	// request with its key is still being handled
+	inFlightRetryAfter = "1"
+)
+
+func parseIdempotencyWindow(source configSource) (time.Duration, error) {
+	value := source.get(IdempotencyWindowEnvVar)
+	if value == "" {
+		return defaultIdempotencyWindow, nil
+	}
+	return parsePositiveDuration(IdempotencyWindowEnvVar, value)
+}
+
+// idempotentResponse is the response to the first request sent with an Idempotency-Key
+type idempotentResponse struct {
+	// fingerprint identifies the method, path and body of the first request
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	// done is false while the first request is still being handled
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyCache keeps the responses to requests sent with an Idempotency-Key for
+// IDEMPOTENCY_WINDOW, so a retry is answered with the original response instead of
+// storing its messages again. Responses are only kept in memory, so they do not survive
+// a restart of the receiver even with the file message store.
+type idempotencyCache struct {
+	mu sync.Mutex
+	// responses maps each user to the responses cached for their Idempotency-Keys, at most
+	// maxIdempotencyKeysPerUser of them
+	responses map[string]map[string]*idempotentResponse
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{responses: map[string]map[string]*idempotentResponse{}}
+}
+
+// serve calls handler for the first request sent with the key and caches its response, and
+// replays that response for later requests with the same method, path and body. A request
+// that reuses the key for anything else is rejected with 422 Unprocessable Entity. Server
+// errors are not cached, so the request can be retried.
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, userID, key string, body []byte, handler func(http.ResponseWriter)) {
+	if len(key) > maxIdempotencyKeyLength {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	fingerprint := requestFingerprint(r, body)
+	now := time.Now()
+
+	c.mu.Lock()
+	userResponses, ok := c.responses[userID]
+	if !ok {
+		userResponses = map[string]*idempotentResponse{}
+		c.responses[userID] = userResponses
+	}
+	cached, ok := userResponses[key]
+	if ok && now.After(cached.expires) {
+		delete(userResponses, key)
+		ok = false
+	}
+	if !ok {
+		if len(userResponses) >= maxIdempotencyKeysPerUser {
+			forgetOldestResponse(userResponses)
+		}
+		cached = &idempotentResponse{
+			fingerprint: fingerprint,
+			expires:     now.Add(currentConfig().idempotencyWindow),
+		}
+		userResponses[key] = cached
+	}
+	replay := *cached
+	c.mu.Unlock()
+
+	if ok {
+		switch {
+		case replay.fingerprint != fingerprint:
+			log.Printf("Rejecting reused %s for user %s", IdempotencyKeyHeader, userID)
+			writeJSONError(w, http.StatusUnprocessableEntity,
+				fmt.Sprintf("%s was already used for a different request", IdempotencyKeyHeader))
+		case !replay.done:
+			// 425 rather than 409, which rejects a duplicate batch and must not be retried
+			w.Header().Set("Retry-After", inFlightRetryAfter)
+			writeJSONError(w, http.StatusTooEarly,
+				fmt.Sprintf("a request with this %s is still being handled", IdempotencyKeyHeader))
+		default:
+			metrics.idempotentReplays.inc(userID, r.URL.Path)
+			if replay.contentType != "" {
+				w.Header().Set("Content-Type", replay.contentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(replay.status)
+			if _, err := w.Write(replay.body); err != nil {
+				log.Printf("Error writing replayed response for user %s: %v", userID, err)
+			}
+		}
+		return
+	}
+
+	capture := &capturingWriter{ResponseWriter: w}
+	handler(capture)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if capture.status >= http.StatusInternalServerError {
+		if c.responses[userID][key] == cached {
+			delete(c.responses[userID], key)
+		}
+		return
+	}
+	cached.done = true
+	cached.status = capture.status
+	if cached.status == 0 {
+		cached.status = http.StatusOK
+	}
+	cached.contentType = w.Header().Get("Content-Type")
+	cached.body = capture.body.Bytes()
+}
+
+// clear forgets the user's keys along with their messages, so requests sent again after
+// /clear_messages are stored
+func (c *idempotencyCache) clear(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.responses, userID)
+}
+
+// expire removes the responses cached for longer than IDEMPOTENCY_WINDOW, and is called
+// periodically by the janitor
+func (c *idempotencyCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for userID, userResponses := range c.responses {
+		for key, cached := range userResponses {
+			if now.After(cached.expires) {
+				delete(userResponses, key)
+			}
+		}
+		if len(userResponses) == 0 {
+			delete(c.responses, userID)
+		}
+	}
+}
+
+// forgetOldestResponse removes the response that expires first, to make room for another
+func forgetOldestResponse(userResponses map[string]*idempotentResponse) {
+	var oldestKey string
+	var oldest *idempotentResponse
+	for key, cached := range userResponses {
+		if oldest == nil || cached.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, cached
+		}
+	}
+	delete(userResponses, oldestKey)
+}
+
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+	_, _ = hash.Write(body)
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], hash.Sum(nil))
+	return fingerprint
+}
+
+// capturingWriter copies the status and body a handler responds with
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *capturingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *capturingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,238 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Idempotency keys", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	post := func(path, authHeaderContent, idempotencyKey string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, serverUrl+path, bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", authHeaderContent)
+		req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("replays the first response without storing the messages again", func() {
+		resp := post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(BeEmpty())
+
+		resp = post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(Equal("true"))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+
+		resp = makeRequest(http.MethodGet, serverUrl+"/metrics", "", nil)
+		defer func() { _ = resp.Body.Close() }()
+		metrics, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metrics)).To(ContainSubstring(`telemetry_receiver_idempotent_replays_total{user="user-id",endpoint="/components"} 1` + "\n"))
+	})
+
+	It("does not store a resent batch twice", func() {
+		tarball := generateTarFileContents("best-foundation-id", true)
+		for i := 0; i < 2; i++ {
+			resp := post("/collections/batch", validTokenContent, "batch-key", tarball)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		}
+
+		batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+		Expect(batches).To(HaveLen(1))
+		Expect(batches[0]).To(HaveKeyWithValue("Duplicate", false))
+	})
+
+	It("replays error responses", func() {
+		resp := post("/components", validTokenContent, "key-1", []byte("{\"n\": 1}\nnull\n"))
+		first, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		resp = post("/components", validTokenContent, "key-1", []byte("{\"n\": 1}\nnull\n"))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(Equal("true"))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(io.ReadAll(resp.Body)).To(Equal(first))
+	})
+
+	It("asks for a repeat sent while the first request is still being handled to be retried", func() {
+		// Enough messages that the first request is still being stored when the repeat arrives
+		var body []byte
+		for i := 0; i < 2000; i++ {
+			body = append(body, generateTelemetryMsg()...)
+		}
+
+		attempt := 0
+		Eventually(func() []int {
+			attempt++
+			key := "in-flight-" + strconv.Itoa(attempt)
+			responses := make(chan *http.Response, 2)
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+					resp := post("/components", validTokenContent, key, body)
+					_ = resp.Body.Close()
+					responses <- resp
+				}()
+			}
+
+			var statuses []int
+			for i := 0; i < 2; i++ {
+				resp := <-responses
+				if resp.StatusCode == http.StatusTooEarly {
+					Expect(resp.Header.Get("Retry-After")).To(Equal("1"))
+				}
+				statuses = append(statuses, resp.StatusCode)
+			}
+			return statuses
+		}).WithTimeout(10 * time.Second).Should(ConsistOf(http.StatusCreated, http.StatusTooEarly))
+	})
+
+	It("rejects a key reused with a different body", func() {
+		resp := post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = post("/components", validTokenContent, "key-1", []byte(`{"n": 1}`))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		var body map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body["error"]).To(ContainSubstring(IdempotencyKeyHeader))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+	})
+
+	It("rejects a key reused on another endpoint", func() {
+		resp := post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = post("/collections/batch", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("keeps the keys of each user apart", func() {
+		for _, token := range []string{validTokenContent, "Bearer second-token"} {
+			resp := post("/components", token, "key-1", generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(resp.Header.Get(IdempotentReplayedHeader)).To(BeEmpty())
+		}
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer second-token")).To(HaveLen(2))
+	})
+
+	It("forgets keys when the user's messages are cleared", func() {
+		resp := post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/clear_messages", validTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp = post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(BeEmpty())
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+	})
+
+	It("forgets the oldest keys of a user with too many", func() {
+		resp := post("/components", validTokenContent, "key-0", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		for i := 1; i <= 1000; i++ {
+			resp := post("/components", validTokenContent, "key-"+strconv.Itoa(i), []byte(`{"n": 1}`))
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		}
+
+		resp = post("/components", validTokenContent, "key-1000", []byte(`{"n": 1}`))
+		_ = resp.Body.Close()
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(Equal("true"))
+
+		resp = post("/components", validTokenContent, "key-0", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(IdempotentReplayedHeader)).To(BeEmpty())
+	})
+
+	It("rejects keys that are too long", func() {
+		resp := post("/components", validTokenContent, strings.Repeat("k", 256), generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+	})
+
+	Context("with a short window", func() {
+		BeforeEach(func() {
+			envs[IdempotencyWindowEnvVar] = "200ms"
+		})
+
+		It("stores the request again once the window has passed", func() {
+			resp := post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+			_ = resp.Body.Close()
+			time.Sleep(300 * time.Millisecond)
+
+			resp = post("/components", validTokenContent, "key-1", generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(resp.Header.Get(IdempotentReplayedHeader)).To(BeEmpty())
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(4))
+		})
+	})
+
+	DescribeTable("when the window is invalid, it exits nonzero",
+		func(window string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:              "0",
+				ApiKeysEnvVar:           `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar:      "50",
+				IdempotencyWindowEnvVar: window,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidIdempotencyWindowError + ": " + IdempotencyWindowEnvVar))
+		},
+		Entry("not a duration", "a day"),
+		Entry("not positive", "0s"),
+	)
+})
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeyRotationOverlap = time.Hour
+
+	keySourceConfig  = "config"
+	keySourceRuntime = "runtime"
+)
+
+var (
+	errKeyNotFound   = errors.New("key not found")
+	errConfiguredKey = errors.New("keys configured in " + ApiKeysEnvVar + " can only be changed in the configuration")
+)
+
+// storedKey is an API key created through the admin API, as persisted in the message store
+type storedKey struct {
+	UserID string `json:"user_id"`
+	// Digest is the hex SHA-256 digest of the key. Keys are random 256 bit values, so unlike
+	// passwords they need neither a salt nor a slow hash.
+	Digest string `json:"digest"`
+	// Scopes are empty for keys created before keys had scopes, which have the default scopes
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (k storedKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (k storedKey) scopes() []string {
+	if len(k.Scopes) == 0 {
+		return defaultScopes
+	}
+	return k.Scopes
+}
+
+func (k storedKey) info() apiKeyInfo {
+	createdAt := k.CreatedAt
+	return apiKeyInfo{
+		UserID:      k.UserID,
+		Fingerprint: k.Digest[:2*fingerprintSize],
+		Source:      keySourceRuntime,
+		Scopes:      k.scopes(),
+		CreatedAt:   &createdAt,
+		ExpiresAt:   k.ExpiresAt,
+	}
+}
+
+// fingerprintSize is the number of bytes of a key's SHA-256 digest that identify it
+const fingerprintSize = 8
+
+func fingerprint(digest [sha256.Size]byte) string {
+	return hex.EncodeToString(digest[:fingerprintSize])
+}
+
+// apiKeyInfo describes an API key without revealing it
+type apiKeyInfo struct {
+	UserID      string     `json:"user_id"`
+	Fingerprint string     `json:"fingerprint"`
+	Source      string     `json:"source"`
+	Scopes      []string   `json:"scopes"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// createdKey is returned once when a key is created, as only its digest is kept
+type createdKey struct {
+	apiKeyInfo
+	Key string `json:"key"`
+}
+
+// runtimeKeyring holds the API keys created through the admin API, saving every change to
+// the message store so the keys last as long as the stored messages
+type runtimeKeyring struct {
+	// mu protects keys and serializes saving them, so the store holds the latest keys
+	mu    sync.RWMutex
+	store MessageStore
+	// keys indexes the keys by their digest
+	keys map[[sha256.Size]byte]storedKey
+}
+
+func loadRuntimeKeyring(store MessageStore) (*runtimeKeyring, error) {
+	stored, err := store.Keys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API keys: %w", err)
+	}
+
+	k := &runtimeKeyring{store: store, keys: map[[sha256.Size]byte]storedKey{}}
+	for _, key := range stored {
+		digest, err := hex.DecodeString(key.Digest)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("stored API key for user %s has an invalid digest", key.UserID)
+		}
+		k.keys[[sha256.Size]byte(digest)] = key
+	}
+	return k, nil
+}
+
+func (k *runtimeKeyring) authenticate(token string) (keyOwner, bool) {
+	if token == "" {
+		return keyOwner{}, false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	// The lookup compares digests rather than keys, so its timing reveals nothing about the keys
+	key, ok := k.keys[sha256.Sum256([]byte(token))]
+	if !ok || key.expired(time.Now()) {
+		return keyOwner{}, false
+	}
+	return keyOwner{userID: key.UserID, fingerprint: key.Digest[:2*fingerprintSize], scopes: key.scopes()}, true
+}
+
+func (k *runtimeKeyring) list(userID string) []apiKeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	var keys []apiKeyInfo
+	for _, key := range k.keys {
+		if (userID == "" || key.UserID == userID) && !key.expired(now) {
+			keys = append(keys, key.info())
+		}
+	}
+	return keys
+}
+
+func (k *runtimeKeyring) create(userID string, scopes []string) (createdKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.createLocked(userID, scopes, nil)
+}
+
+// rotate creates a new key for the user with the same scopes, and expires the key with the
+// given fingerprint once the overlap has passed, so clients can switch keys without failing requests
+func (k *runtimeKeyring) rotate(userID, keyFingerprint string, overlap time.Duration) (createdKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	digest, key, ok := k.findLocked(userID, keyFingerprint)
+	if !ok {
+		return createdKey{}, errKeyNotFound
+	}
+
+	expiresAt := time.Now().Add(overlap)
+	if key.ExpiresAt == nil || expiresAt.Before(*key.ExpiresAt) {
+		key.ExpiresAt = &expiresAt
+	}
+	return k.createLocked(userID, key.Scopes, map[[sha256.Size]byte]storedKey{digest: key})
+}
+
+func (k *runtimeKeyring) revoke(userID, keyFingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	digest, _, ok := k.findLocked(userID, keyFingerprint)
+	if !ok {
+		return errKeyNotFound
+	}
+
+	keys := k.copyLocked()
+	delete(keys, digest)
+	return k.saveLocked(keys)
+}
+
+// createLocked generates a key for the user and saves it along with the changed keys.
+// Callers must hold k.mu.
+func (k *runtimeKeyring) createLocked(userID string, scopes []string, changed map[[sha256.Size]byte]storedKey) (createdKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return createdKey{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	digest := sha256.Sum256([]byte(token))
+
+	key := storedKey{
+		UserID:    userID,
+		Digest:    hex.EncodeToString(digest[:]),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	keys := k.copyLocked()
+	for changedDigest, changedKey := range changed {
+		keys[changedDigest] = changedKey
+	}
+	keys[digest] = key
+	if err := k.saveLocked(keys); err != nil {
+		return createdKey{}, err
+	}
+	return createdKey{apiKeyInfo: key.info(), Key: token}, nil
+}
+
+// findLocked returns the unexpired key with the fingerprint. Callers must hold k.mu.
+func (k *runtimeKeyring) findLocked(userID, keyFingerprint string) ([sha256.Size]byte, storedKey, bool) {
+	now := time.Now()
+	for digest, key := range k.keys {
+		if key.UserID == userID && fingerprint(digest) == keyFingerprint && !key.expired(now) {
+			return digest, key, true
+		}
+	}
+	return [sha256.Size]byte{}, storedKey{}, false
+}
+
+// copyLocked returns a copy of the unexpired keys. Callers must hold k.mu.
+func (k *runtimeKeyring) copyLocked() map[[sha256.Size]byte]storedKey {
+	now := time.Now()
+	keys := make(map[[sha256.Size]byte]storedKey, len(k.keys))
+	for digest, key := range k.keys {
+		if !key.expired(now) {
+			keys[digest] = key
+		}
+	}
+	return keys
+}
+
+// saveLocked saves the keys to the message store, and only then starts using them.
+// Callers must hold k.mu.
+func (k *runtimeKeyring) saveLocked(keys map[[sha256.Size]byte]storedKey) error {
+	stored := make([]storedKey, 0, len(keys))
+	for _, key := range keys {
+		stored = append(stored, key)
+	}
+	if err := k.store.SaveKeys(stored); err != nil {
+		return fmt.Errorf("failed to save API keys: %w", err)
+	}
+	k.keys = keys
+	return nil
+}
+
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("user")
+	if userID == "" {
+		// A key with the admin scope lists its own user's keys
+		adminUserID, ok := adminAuthorized(w, r)
+		if !ok {
+			return
+		}
+		userID = adminUserID
+	} else if !keysAdminAuthorized(w, r, userID) {
+		return
+	}
+
+	keys := append(currentConfig().apiKeys.list(userID), runtimeKeys.list(userID)...)
+	slices.SortFunc(keys, func(a, b apiKeyInfo) int {
+		if c := strings.Compare(a.UserID, b.UserID); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Source, b.Source); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Fingerprint, b.Fingerprint)
+	})
+	if keys == nil {
+		keys = []apiKeyInfo{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+func createKey(w http.ResponseWriter, r *http.Request) {
+	if !keysAdminAuthorized(w, r, r.PathValue("user")) {
+		return
+	}
+
+	var creation keyCreation
+	if err := json.NewDecoder(r.Body).Decode(&creation); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid key creation: %v", err))
+		return
+	}
+	scopes, err := keyScopes(creation.Scopes)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid key creation: %v", err))
+		return
+	}
+
+	key, err := runtimeKeys.create(r.PathValue("user"), scopes)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created API key %s for user %s", key.Fingerprint, key.UserID)
+	writeJSON(w, http.StatusCreated, key)
+}
+
+// keyCreation is the optional body of a key creation request
+type keyCreation struct {
+	// Scopes are the scopes of the new key, which has the default scopes when they are omitted
+	Scopes []string `json:"scopes"`
+}
+
+// keyRotation is the optional body of a key rotation request
+type keyRotation struct {
+	// Overlap is how long the rotated key keeps working, as a Go duration
+	Overlap string `json:"overlap"`
+}
+
+func rotateKey(w http.ResponseWriter, r *http.Request) {
+	if !keysAdminAuthorized(w, r, r.PathValue("user")) {
+		return
+	}
+
+	var rotation keyRotation
+	if err := json.NewDecoder(r.Body).Decode(&rotation); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid key rotation: %v", err))
+		return
+	}
+	overlap := defaultKeyRotationOverlap
+	if rotation.Overlap != "" {
+		var err error
+		overlap, err = time.ParseDuration(rotation.Overlap)
+		if err != nil || overlap < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid key rotation: overlap must be a duration of at least 0s")
+			return
+		}
+	}
+
+	userID, keyFingerprint := r.PathValue("user"), r.PathValue("fingerprint")
+	key, err := runtimeKeys.rotate(userID, keyFingerprint, overlap)
+	if err != nil {
+		writeKeyError(w, userID, keyFingerprint, err)
+		return
+	}
+	log.Printf("Rotated API key %s for user %s to %s, with an overlap of %s", keyFingerprint, userID, key.Fingerprint, overlap)
+	writeJSON(w, http.StatusCreated, key)
+}
+
+func revokeKey(w http.ResponseWriter, r *http.Request) {
+	if !keysAdminAuthorized(w, r, r.PathValue("user")) {
+		return
+	}
+
+	userID, keyFingerprint := r.PathValue("user"), r.PathValue("fingerprint")
+	if err := runtimeKeys.revoke(userID, keyFingerprint); err != nil {
+		writeKeyError(w, userID, keyFingerprint, err)
+		return
+	}
+	log.Printf("Revoked API key %s for user %s", keyFingerprint, userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeKeyError(w http.ResponseWriter, userID, keyFingerprint string, err error) {
+	if !errors.Is(err, errKeyNotFound) {
+		log.Printf("Error changing API key %s for user %s: %v", keyFingerprint, userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if currentConfig().apiKeys.hasFingerprint(userID, keyFingerprint) {
+		writeJSONError(w, http.StatusConflict, errConfiguredKey.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,195 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Admin key management", func() {
+	const adminTokenContent = "Bearer admin-token"
+
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{AdminApiKeyEnvVar: "admin-token"}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	decode := func(resp *http.Response, expectedStatus int, into interface{}) {
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(expectedStatus))
+		Expect(json.NewDecoder(resp.Body).Decode(into)).To(Succeed())
+	}
+
+	createKey := func(userID string) map[string]interface{} {
+		var key map[string]interface{}
+		decode(makeRequest(http.MethodPost, serverUrl+"/admin/keys/"+userID, adminTokenContent, nil), http.StatusCreated, &key)
+		return key
+	}
+
+	listKeys := func(path string) []map[string]interface{} {
+		var keys []map[string]interface{}
+		decode(makeRequest(http.MethodGet, serverUrl+path, adminTokenContent, nil), http.StatusOK, &keys)
+		return keys
+	}
+
+	statusFor := func(key map[string]interface{}) int {
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", "Bearer "+key["key"].(string), nil)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("requires the admin token", func() {
+		for _, req := range []struct{ method, path string }{
+			{http.MethodGet, "/admin/keys"},
+			{http.MethodPost, "/admin/keys/new-team"},
+			{http.MethodPost, "/admin/keys/new-team/0011223344556677/rotate"},
+			{http.MethodDelete, "/admin/keys/new-team/0011223344556677"},
+		} {
+			resp := makeRequest(req.method, serverUrl+req.path, "Bearer wrong-token", nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized), req.path)
+
+			resp = makeRequest(req.method, serverUrl+req.path, validTokenContent, nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden), req.path)
+		}
+	})
+
+	It("creates keys for new users that work immediately", func() {
+		key := createKey("new-team")
+		Expect(key).To(HaveKeyWithValue("user_id", "new-team"))
+		Expect(key).To(HaveKeyWithValue("source", "runtime"))
+		Expect(key).To(HaveKeyWithValue("fingerprint", MatchRegexp("^[0-9a-f]{16}$")))
+		Expect(key).To(HaveKey("created_at"))
+
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer "+key["key"].(string), generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer "+key["key"].(string))).To(HaveLen(2))
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+	})
+
+	It("lists keys by fingerprint without revealing them", func() {
+		key := createKey("user-id")
+
+		keys := listKeys("/admin/keys/user-id")
+		Expect(keys).To(HaveLen(2))
+		Expect(keys[0]).To(HaveKeyWithValue("source", "config"))
+		Expect(keys[1]).To(HaveKeyWithValue("fingerprint", key["fingerprint"]))
+		for _, listed := range keys {
+			Expect(listed).NotTo(HaveKey("key"))
+		}
+
+		Expect(listKeys("/admin/keys")).To(HaveLen(3))
+		Expect(listKeys("/admin/keys/nobody")).To(BeEmpty())
+	})
+
+	It("rotates keys, keeping the old key working during the overlap", func() {
+		oldKey := createKey("new-team")
+
+		var newKey map[string]interface{}
+		decode(makeRequest(http.MethodPost, serverUrl+"/admin/keys/new-team/"+oldKey["fingerprint"].(string)+"/rotate",
+			adminTokenContent, []byte(`{"overlap": "1s"}`)), http.StatusCreated, &newKey)
+		Expect(newKey["fingerprint"]).NotTo(Equal(oldKey["fingerprint"]))
+
+		Expect(statusFor(newKey)).To(Equal(http.StatusOK))
+		Expect(statusFor(oldKey)).To(Equal(http.StatusOK))
+		Expect(listKeys("/admin/keys/new-team")).To(ContainElement(And(
+			HaveKeyWithValue("fingerprint", oldKey["fingerprint"]),
+			HaveKey("expires_at"),
+		)))
+
+		Eventually(func() int { return statusFor(oldKey) }).WithTimeout(2 * time.Second).Should(Equal(http.StatusUnauthorized))
+		Expect(statusFor(newKey)).To(Equal(http.StatusOK))
+		Expect(listKeys("/admin/keys/new-team")).To(HaveLen(1))
+	})
+
+	It("rotates keys without an overlap", func() {
+		oldKey := createKey("new-team")
+
+		var newKey map[string]interface{}
+		decode(makeRequest(http.MethodPost, serverUrl+"/admin/keys/new-team/"+oldKey["fingerprint"].(string)+"/rotate",
+			adminTokenContent, []byte(`{"overlap": "0s"}`)), http.StatusCreated, &newKey)
+
+		Expect(statusFor(oldKey)).To(Equal(http.StatusUnauthorized))
+		Expect(statusFor(newKey)).To(Equal(http.StatusOK))
+	})
+
+	It("rejects an invalid overlap", func() {
+		key := createKey("new-team")
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/keys/new-team/"+key["fingerprint"].(string)+"/rotate",
+			adminTokenContent, []byte(`{"overlap": "-1h"}`))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("revokes keys", func() {
+		key := createKey("new-team")
+		path := serverUrl + "/admin/keys/new-team/" + key["fingerprint"].(string)
+
+		resp := makeRequest(http.MethodDelete, path, adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(statusFor(key)).To(Equal(http.StatusUnauthorized))
+
+		resp = makeRequest(http.MethodDelete, path, adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("does not change configured keys", func() {
+		configured := listKeys("/admin/keys/user-id")[0]
+		path := serverUrl + "/admin/keys/user-id/" + configured["fingerprint"].(string)
+
+		resp := makeRequest(http.MethodDelete, path, adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+
+		resp = makeRequest(http.MethodPost, path+"/rotate", adminTokenContent, nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+	})
+
+	Context("with the file message store", func() {
+		BeforeEach(func() {
+			envs[MessageStoreEnvVar] = "file"
+			envs[MessageStorePathEnvVar] = filepath.Join(GinkgoT().TempDir(), "messages.log")
+		})
+
+		It("keeps key changes across restarts", func() {
+			kept := createKey("new-team")
+			revoked := createKey("new-team")
+			resp := makeRequest(http.MethodDelete, serverUrl+"/admin/keys/new-team/"+revoked["fingerprint"].(string), adminTokenContent, nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+			session, serverUrl = startServerAndWait(envs)
+
+			Expect(statusFor(kept)).To(Equal(http.StatusOK))
+			Expect(statusFor(revoked)).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultMaxBodySize         = 64 << 20
+	defaultMaxDecompressedSize = 256 << 20
+	defaultMaxTarEntries       = 10000
+	defaultMaxTarEntrySize     = 64 << 20
+)
+
+// sizeLimits bound the resources a single request can consume, so an oversized or
+// malicious upload is rejected instead of exhausting the receiver's memory
+type sizeLimits struct {
+	bodySize         int64
+	decompressedSize int64
+	tarEntries       int64
+	tarEntrySize     int64
+}
+
+func parseSizeLimits(source configSource) (sizeLimits, error) {
+	limits := sizeLimits{
+		bodySize:         defaultMaxBodySize,
+		decompressedSize: defaultMaxDecompressedSize,
+		tarEntries:       defaultMaxTarEntries,
+		tarEntrySize:     defaultMaxTarEntrySize,
+	}
+
+	for envVar, limit := range map[string]*int64{
+		MaxBodySizeEnvVar:         &limits.bodySize,
+		MaxDecompressedSizeEnvVar: &limits.decompressedSize,
+		MaxTarEntriesEnvVar:       &limits.tarEntries,
+		MaxTarEntrySizeEnvVar:     &limits.tarEntrySize,
+	} {
+		value := source.get(envVar)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return sizeLimits{}, fmt.Errorf("%s: %w", envVar, err)
+		}
+		if parsed <= 0 {
+			return sizeLimits{}, fmt.Errorf("%s must be a positive integer", envVar)
+		}
+		*limit = parsed
+	}
+
+	return limits, nil
+}
+
+// limitError is returned when a request exceeds one of the configured size limits
+type limitError struct {
+	// Limit is the environment variable that configures the exceeded limit
+	Limit  string `json:"limit"`
+	Max    int64  `json:"max"`
+	Reason string `json:"error"`
+}
+
+func (e *limitError) Error() string {
+	return e.Reason
+}
+
+func bodySizeLimitError() *limitError {
+	limits := currentConfig().limits
+	return &limitError{
+		Limit:  MaxBodySizeEnvVar,
+		Max:    limits.bodySize,
+		Reason: fmt.Sprintf("request body exceeds %d bytes", limits.bodySize),
+	}
+}
+
+func decompressedSizeLimitError() *limitError {
+	limits := currentConfig().limits
+	return &limitError{
+		Limit:  MaxDecompressedSizeEnvVar,
+		Max:    limits.decompressedSize,
+		Reason: fmt.Sprintf("decompressed request body exceeds %d bytes", limits.decompressedSize),
+	}
+}
+
+func tarEntriesLimitError() *limitError {
+	limits := currentConfig().limits
+	return &limitError{
+		Limit:  MaxTarEntriesEnvVar,
+		Max:    limits.tarEntries,
+		Reason: fmt.Sprintf("tarball contains more than %d entries", limits.tarEntries),
+	}
+}
+
+func tarEntrySizeLimitError(name string) *limitError {
+	limits := currentConfig().limits
+	return &limitError{
+		Limit:  MaxTarEntrySizeEnvVar,
+		Max:    limits.tarEntrySize,
+		Reason: fmt.Sprintf("tarball entry %s exceeds %d bytes", name, limits.tarEntrySize),
+	}
+}
+
+func writeLimitError(w http.ResponseWriter, userID string, err *limitError) {
+	log.Printf("Rejecting request for user %s: %v", userID, err)
+	writeJSON(w, http.StatusRequestEntityTooLarge, err)
+}
+
+// limitedReader reads from a decompressing reader until it produces more than max
+// bytes, then fails with the limit's error rather than silently truncating
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+	err       *limitError
+}
+
+func newDecompressedSizeReader(reader io.Reader) *limitedReader {
+	err := decompressedSizeLimitError()
+	return &limitedReader{reader: reader, remaining: err.Max, err: err}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, l.err
+	}
+	// Read one byte past the limit to tell a body of exactly max bytes from a larger one
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), l.err
+	}
+	return n, err
+}
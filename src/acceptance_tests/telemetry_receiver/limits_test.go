@@ -0,0 +1,143 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Size limits", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = nil
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	expectTooLarge := func(resp *http.Response, limit string, max int) {
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		var body map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body).To(HaveKeyWithValue("limit", limit))
+		Expect(body).To(HaveKeyWithValue("max", BeNumerically("==", max)))
+		Expect(body).To(HaveKey("error"))
+	}
+
+	Context("with a body size limit", func() {
+		BeforeEach(func() {
+			envs = map[string]string{MaxBodySizeEnvVar: "300"}
+		})
+
+		It("rejects larger request bodies", func() {
+			body := bytes.Repeat([]byte(`{"telemetry-source": "my-component"}`+"\n"), 10)
+			expectTooLarge(makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, body), "MAX_BODY_SIZE", 300)
+
+			tarball := tarForContents(bytes.Repeat([]byte("x"), 400), "opsmanager/data")
+			expectTooLarge(makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, false, tarball), "MAX_BODY_SIZE", 300)
+
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+			Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(BeEmpty())
+		})
+
+		It("accepts request bodies up to the limit", func() {
+			body := bytes.Repeat([]byte(`{"telemetry-source": "my-component"}`+"\n"), 8)
+			body = append(body, bytes.Repeat([]byte(" "), 300-len(body))...)
+
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, body)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("with a decompressed size limit", func() {
+		BeforeEach(func() {
+			envs = map[string]string{MaxDecompressedSizeEnvVar: "100000"}
+		})
+
+		It("rejects tarballs that decompress to more than the limit", func() {
+			bomb := gzippedTarForContents(make([]byte, 10<<20), "opsmanager/data")
+			Expect(len(bomb)).To(BeNumerically("<", 100000))
+
+			expectTooLarge(makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, bomb), "MAX_DECOMPRESSED_SIZE", 100000)
+			Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(BeEmpty())
+		})
+
+		It("accepts tarballs that decompress to less than the limit", func() {
+			resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("some-foundation", true))
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("with tar entry limits", func() {
+		BeforeEach(func() {
+			envs = map[string]string{MaxTarEntriesEnvVar: "2", MaxTarEntrySizeEnvVar: "100"}
+		})
+
+		It("rejects tarballs with too many entries", func() {
+			tarball := tarForEntries(
+				tarEntry{Name: "a/data", Contents: []byte("{}")},
+				tarEntry{Name: "b/data", Contents: []byte("{}")},
+				tarEntry{Name: "c/data", Contents: []byte("{}")},
+			)
+			expectTooLarge(makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, false, tarball), "MAX_TAR_ENTRIES", 2)
+		})
+
+		It("rejects tarballs with an entry larger than the limit", func() {
+			tarball := gzipContents(tarForEntries(
+				tarEntry{Name: "a/data", Contents: []byte("{}")},
+				tarEntry{Name: "b/data", Contents: bytes.Repeat([]byte("x"), 101)},
+			))
+			expectTooLarge(makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, tarball), "MAX_TAR_ENTRY_SIZE", 100)
+		})
+
+		It("accepts tarballs within the limits", func() {
+			tarball := tarForEntries(
+				tarEntry{Name: "a/data", Contents: []byte("{}")},
+				tarEntry{Name: "b/data", Contents: bytes.Repeat([]byte("x"), 100)},
+			)
+			resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, false, tarball)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	DescribeTable("when a size limit configuration is invalid, it exits nonzero",
+		func(envVar, value string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar: "50",
+				envVar:             value,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidSizeLimitError + ": " + envVar))
+		},
+		Entry("unparseable", MaxBodySizeEnvVar, "1MB"),
+		Entry("zero", MaxTarEntriesEnvVar, "0"),
+		Entry("negative", MaxTarEntrySizeEnvVar, "-1"),
+	)
+})
@@ -3,8 +3,13 @@ package main
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,29 +18,106 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 const (
+	ConfigFileEnvVar          = "CONFIG_FILE"
+	ConfigWatchIntervalEnvVar = "CONFIG_WATCH_INTERVAL"
+
 	PortEnvVar         = "PORT"
 	ApiKeysEnvVar      = "VALID_API_KEYS"
 	MessageLimitEnvVar = "MESSAGE_LIMIT"
 
+	MessageStoreEnvVar     = "MESSAGE_STORE"
+	MessageStorePathEnvVar = "MESSAGE_STORE_PATH"
+
+	MessageTTLEnvVar      = "MESSAGE_TTL"
+	UserMessageTTLsEnvVar = "USER_MESSAGE_TTLS"
+	MemoryBudgetEnvVar    = "MEMORY_BUDGET"
+	JanitorIntervalEnvVar = "JANITOR_INTERVAL"
+
+	ValidateMessagesEnvVar = "VALIDATE_MESSAGES"
+
+	StreamBufferSizeEnvVar = "STREAM_BUFFER_SIZE"
+
+	ReadHeaderTimeoutEnvVar = "READ_HEADER_TIMEOUT"
+	ReadTimeoutEnvVar       = "READ_TIMEOUT"
+	WriteTimeoutEnvVar      = "WRITE_TIMEOUT"
+	IdleTimeoutEnvVar       = "IDLE_TIMEOUT"
+	ShutdownTimeoutEnvVar   = "SHUTDOWN_TIMEOUT"
+
+	MaxBodySizeEnvVar         = "MAX_BODY_SIZE"
+	MaxDecompressedSizeEnvVar = "MAX_DECOMPRESSED_SIZE"
+	MaxTarEntriesEnvVar       = "MAX_TAR_ENTRIES"
+	MaxTarEntrySizeEnvVar     = "MAX_TAR_ENTRY_SIZE"
+
+	AdminApiKeyEnvVar = "ADMIN_API_KEY"
+
+	RateLimitsEnvVar = "RATE_LIMITS"
+
+	DuplicateBatchesEnvVar = "DUPLICATE_BATCHES"
+
+	IdempotencyWindowEnvVar = "IDEMPOTENCY_WINDOW"
+
+	ForwardPortEnvVar   = "FORWARD_PORT"
+	ForwardUserIDEnvVar = "FORWARD_USER_ID"
+
+	ForwardTLSCertPathEnvVar = "FORWARD_TLS_CERT_PATH"
+	ForwardTLSKeyPathEnvVar  = "FORWARD_TLS_KEY_PATH"
+	ForwardTLSCAPathEnvVar   = "FORWARD_TLS_CA_PATH"
+	ForwardSharedKeyEnvVar   = "FORWARD_SHARED_KEY"
+	ForwardHostnameEnvVar    = "FORWARD_HOSTNAME"
+
 	RequiredEnvVarNotSetErrorFormat = "%s environment variable not set"
 	FailedUnmarshalErrorFormat      = "%s failed to json unmarshal"
 	InvalidMessageLimitError        = "message limit configuration invalid"
+	InvalidMessageStoreError        = "message store configuration invalid"
+	InvalidValidateMessagesError    = "message validation configuration invalid"
+	InvalidForwardConfigError       = "forward listener configuration invalid"
+	InvalidStreamBufferSizeError    = "stream buffer size configuration invalid"
+	InvalidServerTimeoutError       = "server timeout configuration invalid"
+	InvalidSizeLimitError           = "size limit configuration invalid"
+	InvalidRetentionError           = "retention configuration invalid"
+	InvalidConfigFileError          = "config file invalid"
+	InvalidApiKeyError              = "api key configuration invalid"
+	InvalidRateLimitError           = "rate limit configuration invalid"
+	InvalidDuplicateBatchesError    = "duplicate batch configuration invalid"
+	InvalidIdempotencyWindowError   = "idempotency window configuration invalid"
 )
 
+// collectionMessages maps message store collections to the messages parsed from a single request
+type collectionMessages map[string][]map[string]interface{}
+
 var (
-	userApiKeys   map[string][]string
-	messages      map[string][]map[string]interface{}
-	batchMessages map[string][]map[string]interface{}
+	// startupConfig holds the settings read from the config file when the receiver started
+	startupConfig configSource
+	// configFileWatcher reloads the config file, and is nil when there is none
+	configFileWatcher *configWatcher
+
+	messageStore MessageStore
 
-	messageLimit int
+	// runtimeKeys are the API keys created through the admin API
+	runtimeKeys *runtimeKeyring
 
-	// messageMutex protects concurrent access to messages and batchMessages maps
-	// These maps are accessed by multiple HTTP handler goroutines simultaneously
-	messageMutex sync.RWMutex
+	faults = newFaultInjector()
+
+	rateLimiting = newRateLimiter()
+
+	deduplicator = newBatchDeduplicator()
+
+	idempotency = newIdempotencyCache()
+
+	metrics = newReceiverMetrics()
+
+	notifier = newMessageNotifier()
+
+	// streamBufferSize is the number of messages buffered for each /stream subscriber before
+	// further messages are dropped
+	streamBufferSize = defaultStreamBufferSize
+	broadcaster      *messageBroadcaster
+
+	timeouts serverTimeouts
 )
 
 func main() {
@@ -44,18 +126,70 @@ func main() {
 		os.Exit(1)
 	}
 
-	bindAddr := fmt.Sprintf(":%s", os.Getenv(PortEnvVar))
+	bindAddr := fmt.Sprintf(":%s", startupConfig.get(PortEnvVar))
 
-	messages = map[string][]map[string]interface{}{}
-	batchMessages = map[string][]map[string]interface{}{}
-	http.HandleFunc("/collections/batch", postMessageHandler(readTarBatch, batchMessages))
-	http.HandleFunc("/components", postMessageHandler(readJSONBatch, messages))
-	http.HandleFunc("/received_messages", readMessagesForUser(messages))
-	http.HandleFunc("/received_batch_messages", readMessagesForUser(batchMessages))
-	http.HandleFunc("/clear_messages", clearMessages)
-	http.HandleFunc("/up", upHandler)
+	config := currentConfig()
+	var err error
+	messageStore, err = newMessageStore(startupConfig.get(MessageStoreEnvVar), startupConfig.get(MessageStorePathEnvVar),
+		config.messageLimit, config.retention)
+	if err != nil {
+		fmt.Printf(InvalidMessageStoreError+": %s\n", err.Error())
+		os.Exit(1)
+	}
+	runtimeKeys, err = loadRuntimeKeyring(messageStore)
+	if err != nil {
+		fmt.Printf(InvalidMessageStoreError+": %s\n", err.Error())
+		os.Exit(1)
+	}
+	// TTLs may be configured by a reload, so the janitor always runs
+	go runJanitor(messageStore, config.retention.janitorInterval)
+	if configFileWatcher != nil {
+		go configFileWatcher.watch()
+	}
+	broadcaster = newMessageBroadcaster(streamBufferSize)
+
+	handleFunc("/collections/batch", postMessageHandler(readTarBatch))
+	handleFunc("/components", postMessageHandler(readJSONBatch))
+	handleFunc("/received_messages", readMessagesForUser(messagesCollection))
+	handleFunc("/received_batch_messages", readMessagesForUser(batchMessagesCollection))
+	handleFunc("/received_batches", readMessagesForUser(batchesCollection))
+	handleFunc("/received_messages/wait", waitForMessages(messagesCollection))
+	handleFunc("/received_batch_messages/wait", waitForMessages(batchMessagesCollection))
+	handleFunc("/received_batches/wait", waitForMessages(batchesCollection))
+	handleFunc("/received_batches/duplicates", readDuplicateBatches)
+	handleFunc("/received_batches/{id}", readBatch)
+	handleFunc("/received_batches/{id}/archive", readBatchArchive)
+	handleFunc("/stream", streamMessages)
+	handleFunc("/clear_messages", clearMessages)
+	handleFunc("/up", upHandler)
+	handleFunc("/metrics", metricsHandler)
+
+	handleFunc("POST /admin/faults", addFaultRule)
+	handleFunc("GET /admin/faults", listFaultRules)
+	handleFunc("DELETE /admin/faults", deleteFaultRules)
+	handleFunc("DELETE /admin/faults/{id}", deleteFaultRule)
+	handleFunc("GET /admin/keys", listKeys)
+	handleFunc("GET /admin/keys/{user}", listKeys)
+	handleFunc("POST /admin/keys/{user}", createKey)
+	handleFunc("POST /admin/keys/{user}/{fingerprint}/rotate", rotateKey)
+	handleFunc("DELETE /admin/keys/{user}/{fingerprint}", revokeKey)
+
+	var forward *forwardServer
+	if forwardPort := startupConfig.get(ForwardPortEnvVar); forwardPort != "" {
+		forward, err = newForwardServerFromConfig(startupConfig)
+		if err != nil {
+			fmt.Printf(InvalidForwardConfigError+": %s\n", err.Error())
+			os.Exit(1)
+		}
+		forwardListener, err := forward.listen(fmt.Sprintf(":%s", forwardPort))
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		go forward.serve(forwardListener)
+	}
 
-	err := http.ListenAndServe(bindAddr, nil)
+	err = serve(bindAddr, timeouts, forward)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -63,18 +197,23 @@ func main() {
 }
 
 func postMessageHandler(
-	messageReader func(contents []byte, contentEncoding string) ([]map[string]interface{}, error),
-	messagesToUpdate map[string][]map[string]interface{}) http.HandlerFunc {
+	messageReader func(contents []byte, header http.Header) (collectionMessages, *receiverMetadata, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, authed := authenticated(r.Header, userApiKeys)
+		userID, authed := authorized(w, r, scopeIngest)
 		if !authed {
-			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
 		// Close body immediately after reading
+		r.Body = http.MaxBytesReader(w, r.Body, currentConfig().limits.bodySize)
 		reqBody, err := io.ReadAll(r.Body)
 		closeErr := r.Body.Close()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			setParseOutcome(r, parseOutcomeTooLarge)
+			writeLimitError(w, userID, bodySizeLimitError())
+			return
+		}
 		if err != nil {
 			log.Printf("Error reading request body for user %s: %v", userID, err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -84,84 +223,220 @@ func postMessageHandler(
 			log.Printf("Error closing request body for user %s: %v", userID, closeErr)
 		}
 
-		recMessages, err := messageReader(reqBody, r.Header.Get("Content-Encoding"))
-		if err != nil {
-			log.Printf("Error parsing messages for user %s: %v", userID, err)
-			w.WriteHeader(http.StatusBadRequest)
+		if injectFault(w, r, userID, reqBody) {
 			return
 		}
 
-		updateMessages(userID, messagesToUpdate, recMessages)
-
-		w.WriteHeader(http.StatusCreated)
+		if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+			idempotency.serve(w, r, userID, key, reqBody, func(w http.ResponseWriter) {
+				receiveMessages(w, r, userID, reqBody, messageReader)
+			})
+			return
+		}
+		receiveMessages(w, r, userID, reqBody, messageReader)
 	}
 }
 
-// updateMessages safely updates the message storage for a user with proper locking
-// to prevent race conditions when multiple HTTP requests arrive concurrently.
-func updateMessages(userID string, messagesToUpdate map[string][]map[string]interface{}, receivedMessages []map[string]interface{}) {
-	messageMutex.Lock()
-	defer messageMutex.Unlock()
+// receiveMessages parses a request body sent to an ingestion endpoint and stores its messages
+func receiveMessages(w http.ResponseWriter, r *http.Request, userID string, reqBody []byte,
+	messageReader func(contents []byte, header http.Header) (collectionMessages, *receiverMetadata, error)) {
+	recMessages, metadata, err := messageReader(reqBody, r.Header)
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		setParseOutcome(r, parseOutcomeTooLarge)
+		writeLimitError(w, userID, limitErr)
+		return
+	}
+	var contractErr *contractError
+	if err != nil {
+		metrics.parseFailures.inc(userID, r.URL.Path)
+	}
+	if errors.As(err, &contractErr) {
+		setParseOutcome(r, parseOutcomeContractViolation)
+		log.Printf("Rejecting messages for user %s: %v", userID, err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":    contractErr.Error(),
+			"messages": contractErr.Messages,
+		})
+		return
+	}
+	if err != nil {
+		setParseOutcome(r, parseOutcomeInvalid)
+		log.Printf("Error parsing messages for user %s: %v", userID, err)
+		var recordErr *recordError
+		if errors.As(err, &recordErr) {
+			writeJSON(w, http.StatusBadRequest, recordErr)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	setParseOutcome(r, parseOutcomeParsed)
 
-	currMessages, ok := messagesToUpdate[userID]
-	if !ok {
-		currMessages = []map[string]interface{}{}
+	err = deduplicator.store(userID, recMessages, metadata)
+	var duplicateErr *duplicateBatchError
+	if errors.As(err, &duplicateErr) {
+		log.Printf("Rejecting duplicate batch for user %s: %v", userID, err)
+		writeJSON(w, http.StatusConflict, duplicateErr)
+		return
+	}
+	if err != nil {
+		log.Printf("Error storing messages for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	messagesToRemove := len(receivedMessages) + len(currMessages) - messageLimit
+	w.WriteHeader(http.StatusCreated)
+}
 
-	if messagesToRemove > 0 {
-		currMessages = currMessages[messagesToRemove:]
+// updateMessages adds the received messages to the user's collections in the message
+// store, which evicts the oldest messages once the message limit is reached, and wakes
+// any requests waiting for or streaming the user's messages. The receiver metadata, which
+// may be nil, is stored next to each of the messages.
+func updateMessages(userID string, receivedMessages collectionMessages, metadata *receiverMetadata) error {
+	defer notifier.notify(userID)
+
+	for collection, msgs := range receivedMessages {
+		if err := messageStore.Append(collection, userID, msgs, metadata); err != nil {
+			return err
+		}
+		if collection != batchArchivesCollection {
+			metrics.messagesStored.add(float64(len(msgs)), userID, collection)
+		}
+		broadcaster.publish(userID, collection, msgs)
 	}
-	messagesToUpdate[userID] = append(currMessages, receivedMessages...)
+	return nil
 }
 
-func readMessagesForUser(receivedMessages map[string][]map[string]interface{}) http.HandlerFunc {
+func readMessagesForUser(collection string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, authed := authenticated(r.Header, userApiKeys)
+		userID, authed := authorized(w, r, scopeRead)
 		if !authed {
-			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		messageMutex.RLock()
-		userMessages, ok := receivedMessages[userID]
-		// Make a copy of the messages to avoid holding the lock during marshaling
-		messagesCopy := make([]map[string]interface{}, len(userMessages))
-		copy(messagesCopy, userMessages)
-		messageMutex.RUnlock()
+		query, err := parseMessageQuery(collection, r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		if ok && len(messagesCopy) > 0 {
-			msgBytes, err := json.Marshal(&messagesCopy)
-			if err != nil {
-				log.Printf("Error marshaling messages for user %s: %v", userID, err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			_, err = w.Write(msgBytes)
-			if err != nil {
-				log.Printf("Error writing response for user %s: %v", userID, err)
-			}
-		} else {
-			_, err := w.Write([]byte("[]"))
-			if err != nil {
-				log.Printf("Error writing empty response for user %s: %v", userID, err)
-			}
+		stored, err := messageStore.Read(collection, userID)
+		if err != nil {
+			log.Printf("Error reading messages for user %s: %v", userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		messagesCopy, nextCursor := query.page(stored)
+		writeMessages(w, userID, messagesCopy, nextCursor)
+	}
+}
+
+func writeMessages(w http.ResponseWriter, userID string, messages []map[string]interface{}, nextCursor string) {
+	if nextCursor != "" {
+		w.Header().Set(NextCursorHeader, nextCursor)
+	}
+
+	if len(messages) > 0 {
+		msgBytes, err := json.Marshal(&messages)
+		if err != nil {
+			log.Printf("Error marshaling messages for user %s: %v", userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(msgBytes)
+		if err != nil {
+			log.Printf("Error writing response for user %s: %v", userID, err)
+		}
+	} else {
+		_, err := w.Write([]byte("[]"))
+		if err != nil {
+			log.Printf("Error writing empty response for user %s: %v", userID, err)
+		}
+	}
+}
+
+// readBatch responds with the /received_batches record of a single batch, including every
+// file its tarball contained
+func readBatch(w http.ResponseWriter, r *http.Request) {
+	userID, authed := authorized(w, r, scopeRead)
+	if !authed {
+		return
+	}
+
+	batches, err := messageStore.Read(batchesCollection, userID)
+	if err != nil {
+		log.Printf("Error reading batches for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	batchID := r.PathValue("id")
+	for _, batch := range batches.Messages {
+		if getString(batch, "Id", "") == batchID {
+			writeJSON(w, http.StatusOK, batch)
+			return
 		}
 	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// readBatchArchive responds with the exact bytes of a tarball sent to /collections/batch,
+// along with the Content-Encoding it was sent with
+func readBatchArchive(w http.ResponseWriter, r *http.Request) {
+	userID, authed := authorized(w, r, scopeRead)
+	if !authed {
+		return
+	}
+
+	archives, err := messageStore.Read(batchArchivesCollection, userID)
+	if err != nil {
+		log.Printf("Error reading batch archives for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	batchID := r.PathValue("id")
+	for _, archive := range archives.Messages {
+		if getString(archive, "Id", "") != batchID {
+			continue
+		}
+
+		archiveBytes, err := base64.StdEncoding.DecodeString(getString(archive, "Archive", ""))
+		if err != nil {
+			log.Printf("Error decoding batch archive %s for user %s: %v", batchID, userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		if contentEncoding := getString(archive, "ContentEncoding", ""); contentEncoding != "" && contentEncoding != encodingIdentity {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(archiveBytes)))
+		if _, err := w.Write(archiveBytes); err != nil {
+			log.Printf("Error writing batch archive %s for user %s: %v", batchID, userID, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
 }
 
 func clearMessages(w http.ResponseWriter, r *http.Request) {
-	userID, authed := authenticated(r.Header, userApiKeys)
+	userID, authed := authorized(w, r, scopeClear)
 	if !authed {
-		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	messageMutex.Lock()
-	delete(messages, userID)
-	delete(batchMessages, userID)
-	messageMutex.Unlock()
+	if err := deduplicator.clear(userID); err != nil {
+		log.Printf("Error clearing messages for user %s: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	idempotency.clear(userID)
+	notifier.notify(userID)
 }
 
 type UpResponse struct {
@@ -202,116 +477,400 @@ func getString(data map[string]interface{}, key, defaultValue string) string {
 	return defaultValue
 }
 
-func authenticated(h http.Header, validUserApiKeys map[string][]string) (string, bool) {
-	authHeaderToken := tokenFromHeader(h)
-	for userID, keys := range validUserApiKeys {
-		for _, validUserKey := range keys {
-			if authHeaderToken == validUserKey {
-				return userID, true
-			}
-		}
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
 	}
-	return "", false
 }
 
-func tokenFromHeader(h http.Header) string {
-	authHeader := h.Get("Authorization")
-	authHeaderParts := strings.Split(authHeader, " ")
-	if len(authHeaderParts) != 2 || (authHeaderParts[0] != "Bearer") {
-		return ""
+func writeJSONError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
+
+const (
+	// ApiKeyHeader carries an API key as an alternative to the Authorization header
+	ApiKeyHeader = "X-Api-Key"
+
+	authRealm = "telemetry-receiver"
+)
+
+// authFailure is why a request was rejected by authorized, as reported in the WWW-Authenticate
+// header and the JSON body of the response
+type authFailure struct {
+	status int
+	// reason identifies the failure in the response body, so clients can tell failures apart
+	reason string
+	// bearerError is the RFC 6750 error code, which is left out when the request had no key
+	bearerError string
+	message     string
+	scope       string
+}
+
+var (
+	missingToken = &authFailure{
+		status:  http.StatusUnauthorized,
+		reason:  "missing_token",
+		message: "request has no API key, send one as Authorization: Bearer <key> or " + ApiKeyHeader + ": <key>",
+	}
+	malformedToken = &authFailure{
+		status:      http.StatusUnauthorized,
+		reason:      "malformed_token",
+		bearerError: "invalid_request",
+		message:     "Authorization header must be formatted as Bearer <key>",
+	}
+	unknownToken = &authFailure{
+		status:      http.StatusUnauthorized,
+		reason:      "unknown_token",
+		bearerError: "invalid_token",
+		message:     "API key is not valid",
+	}
+)
+
+func insufficientScope(scope string) *authFailure {
+	return &authFailure{
+		status:      http.StatusForbidden,
+		reason:      "insufficient_scope",
+		bearerError: "insufficient_scope",
+		message:     fmt.Sprintf("key does not have the %s scope", scope),
+		scope:       scope,
 	}
-	return authHeaderParts[1]
 }
 
-func validateEnvConfigured() error {
-	requiredEnvVars := []string{
-		PortEnvVar,
-		ApiKeysEnvVar,
-		MessageLimitEnvVar,
+// otherUser rejects a key with the admin scope used on another user's keys or fault rules
+func otherUser(userID string) *authFailure {
+	return &authFailure{
+		status:      http.StatusForbidden,
+		reason:      "other_user",
+		bearerError: "insufficient_scope",
+		message:     fmt.Sprintf("key may only manage the keys and fault rules of user %s, use %s for other users", userID, AdminApiKeyEnvVar),
+		scope:       scopeAdmin,
+	}
+}
+
+func (f *authFailure) write(w http.ResponseWriter) {
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+	if f.bearerError != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", f.bearerError, f.message)
+	}
+	if f.scope != "" {
+		challenge += fmt.Sprintf(", scope=%q", f.scope)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeJSON(w, f.status, map[string]string{"error": f.message, "reason": f.reason})
+}
+
+// authenticated returns the owner of the key, configured or created through the admin API, that the request carries
+func authenticated(h http.Header) (keyOwner, *authFailure) {
+	token, failure := tokenFromHeader(h)
+	if failure != nil {
+		return keyOwner{}, failure
+	}
+	if owner, ok := currentConfig().apiKeys.authenticate(token); ok {
+		return owner, nil
+	}
+	if owner, ok := runtimeKeys.authenticate(token); ok {
+		return owner, nil
+	}
+	return keyOwner{}, unknownToken
+}
+
+type requestAuthKey struct{}
+
+// requestAuth is the result of authenticating a request, which instrumented does once so a slow
+// key hash is not computed again by the handler
+type requestAuth struct {
+	owner   keyOwner
+	failure *authFailure
+}
+
+func withRequestAuth(r *http.Request, owner keyOwner, failure *authFailure) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestAuthKey{}, requestAuth{owner: owner, failure: failure}))
+}
+
+// requestAuthenticated returns the owner of the key the request carries, as authenticated by
+// instrumented, authenticating the request itself when it was not
+func requestAuthenticated(r *http.Request) (keyOwner, *authFailure) {
+	if auth, ok := r.Context().Value(requestAuthKey{}).(requestAuth); ok {
+		return auth.owner, auth.failure
+	}
+	return authenticated(r.Header)
+}
+
+// authorized returns the user whose key the request carries when the key has the scope and is
+// within its rate limit. Otherwise it responds with 401 Unauthorized for a missing, malformed or
+// unknown key, 403 Forbidden for a key without the scope, or 429 Too Many Requests. Rejected keys
+// do not use up their rate limit.
+func authorized(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	owner, failure := requestAuthenticated(r)
+	if failure == nil && !owner.allows(scope) {
+		failure = insufficientScope(scope)
+	}
+	if failure != nil {
+		failure.write(w)
+		return "", false
+	}
+	if !rateLimiting.allow(w, owner, requestEndpoint(r)) {
+		return "", false
+	}
+	return owner.userID, true
+}
+
+// adminAuthorized reports whether the request carries the admin key or a key with the admin
+// scope, responding like authorized when it does not. It also returns the user of a key with
+// the admin scope, which may only manage its own user's keys, or an empty user for the admin
+// key, which may manage every user's.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) (string, bool) {
+	adminApiKey := currentConfig().adminApiKey
+	if token, failure := tokenFromHeader(r.Header); adminApiKey != nil && failure == nil && adminApiKey.matches(token) {
+		return "", true
+	}
+	return authorized(w, r, scopeAdmin)
+}
+
+// keysAdminAuthorized reports whether the request may manage the user's keys, responding with
+// 403 Forbidden when it carries a key with the admin scope of another user
+func keysAdminAuthorized(w http.ResponseWriter, r *http.Request, userID string) bool {
+	adminUserID, ok := adminAuthorized(w, r)
+	if ok && adminUserID != "" && adminUserID != userID {
+		otherUser(adminUserID).write(w)
+		return false
+	}
+	return ok
+}
+
+// tokenFromHeader returns the key from an Authorization header with the Bearer scheme, which is
+// case-insensitive, or otherwise from the X-Api-Key header
+func tokenFromHeader(h http.Header) (string, *authFailure) {
+	if authHeader := h.Get("Authorization"); authHeader != "" {
+		scheme, token, ok := strings.Cut(strings.TrimSpace(authHeader), " ")
+		token = strings.TrimSpace(token)
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" || strings.ContainsAny(token, " \t") {
+			return "", malformedToken
+		}
+		return token, nil
+	}
+	if token := strings.TrimSpace(h.Get(ApiKeyHeader)); token != "" {
+		return token, nil
 	}
+	return "", missingToken
+}
 
-	for _, e := range requiredEnvVars {
-		value := os.Getenv(e)
-		if value == "" {
-			return fmt.Errorf(RequiredEnvVarNotSetErrorFormat, e)
+func validateEnvConfigured() error {
+	if path := os.Getenv(ConfigFileEnvVar); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf(InvalidConfigFileError+": %w", err)
+		}
+		source, err := parseConfigFile(path, contents)
+		if err != nil {
+			return fmt.Errorf(InvalidConfigFileError+": %w", err)
+		}
+		startupConfig = source
+		configFileWatcher, err = newConfigWatcher(path, source, contents)
+		if err != nil {
+			return fmt.Errorf(InvalidConfigFileError+": %w", err)
 		}
 	}
 
-	err := json.Unmarshal([]byte(os.Getenv(ApiKeysEnvVar)), &userApiKeys)
+	if startupConfig.get(PortEnvVar) == "" {
+		return fmt.Errorf(RequiredEnvVarNotSetErrorFormat, PortEnvVar)
+	}
+
+	config, err := parseReloadableConfig(startupConfig)
 	if err != nil {
-		return fmt.Errorf(FailedUnmarshalErrorFormat+": %w", ApiKeysEnvVar, err)
+		return err
 	}
+	activeConfig.Store(config)
 
-	messageLimit, err = strconv.Atoi(os.Getenv(MessageLimitEnvVar))
+	timeouts, err = parseServerTimeouts(startupConfig)
 	if err != nil {
-		return fmt.Errorf(InvalidMessageLimitError+": %w", err)
+		return fmt.Errorf(InvalidServerTimeoutError+": %w", err)
+	}
+
+	if value := startupConfig.get(StreamBufferSizeEnvVar); value != "" {
+		streamBufferSize, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf(InvalidStreamBufferSizeError+": %w", err)
+		}
+		if streamBufferSize < 1 {
+			return fmt.Errorf(InvalidStreamBufferSizeError+": %d is not a positive integer", streamBufferSize)
+		}
 	}
 
 	return nil
 }
 
-func readJSONBatch(batchContents []byte, _ string) ([]map[string]interface{}, error) {
-	decoder := json.NewDecoder(bytes.NewReader(batchContents))
-	var jsonObjSlice []map[string]interface{}
-	for {
-		var jsonObj map[string]interface{}
+// readJSONBatch records the messages sent to /components as they were sent, returning the
+// declared and detected encodings of the request body as receiver metadata kept beside them
+func readJSONBatch(contents []byte, header http.Header) (collectionMessages, *receiverMetadata, error) {
+	body, err := decodeBody(contents, header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if err := decoder.Decode(&jsonObj); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+	records, err := parseJSONRecords(body.contents, header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jsonObjSlice := make([]map[string]interface{}, 0, len(records))
+	var invalidMessages []messageViolations
+	for _, record := range records {
+		jsonObjSlice = append(jsonObjSlice, record.message)
+
+		if currentConfig().validateMessages {
+			if violations := validateTelemetryMessage(record.message); len(violations) > 0 {
+				invalidMessages = append(invalidMessages, messageViolations{
+					Line:       record.line,
+					Violations: violations,
+				})
+			}
 		}
-		jsonObjSlice = append(jsonObjSlice, jsonObj)
+	}
+	if len(invalidMessages) > 0 {
+		return nil, nil, &contractError{Messages: invalidMessages}
+	}
 
+	metadata := &receiverMetadata{ContentEncoding: body.declared}
+	if body.detected != encodingIdentity {
+		metadata.DetectedContentEncoding = body.detected
 	}
-	return jsonObjSlice, nil
+	return collectionMessages{messagesCollection: jsonObjSlice}, metadata, nil
 }
 
-func readTarBatch(contents []byte, contentEncoding string) ([]map[string]interface{}, error) {
-
-	var tarReader *tar.Reader
-
-	bytesReader := bytes.NewReader(contents)
-	if contentEncoding == "gzip" {
-		gzipReader, err := gzip.NewReader(bytesReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read gzip contents: %w", err)
-		}
-		tarReader = tar.NewReader(gzipReader)
-	} else {
-		tarReader = tar.NewReader(bytesReader)
+// readTarBatch records a summary of every dataset in the collector's tarball, along
+// with a record of the batch itself describing each regular file it contained, the
+// checksum of the request body and the datasets it is deduplicated by, and the original
+// request body so the tarball can be downloaded again
+func readTarBatch(contents []byte, header http.Header) (collectionMessages, *receiverMetadata, error) {
+	contentEncoding := header.Get("Content-Encoding")
+	body, err := decodeBody(contents, contentEncoding)
+	if err != nil {
+		return nil, nil, err
 	}
+	tarReader := tar.NewReader(bytes.NewReader(body.contents))
 
 	var messagesInTar []map[string]interface{}
+	datasets := []batchDataset{}
+	entries := []map[string]interface{}{}
+	limits := currentConfig().limits
+	var entryCount int64
 	for {
 		hdr, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read header: %w", err)
+			return nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+
+		entryCount++
+		if entryCount > limits.tarEntries {
+			return nil, nil, tarEntriesLimitError()
 		}
 
 		if hdr.Typeflag == tar.TypeReg {
+			if hdr.Size > limits.tarEntrySize {
+				return nil, nil, tarEntrySizeLimitError(hdr.Name)
+			}
+			fileContents, err := io.ReadAll(tarReader)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read file contents %s: %w", hdr.Name, err)
+			}
+			entries = append(entries, tarEntryRecord(hdr, fileContents))
+
 			if strings.HasSuffix(hdr.Name, "metadata") {
 				metadata := struct {
 					CollectedAt  string
 					FoundationId string
 				}{}
 
-				err := json.NewDecoder(tarReader).Decode(&metadata)
+				err := json.NewDecoder(bytes.NewReader(fileContents)).Decode(&metadata)
 				if err != nil {
-					return nil, fmt.Errorf("failed to read file contents %s: %w", hdr.Name, err)
+					return nil, nil, fmt.Errorf("failed to read file contents %s: %w", hdr.Name, err)
 				}
 
+				dataset := batchDataset{
+					FoundationId: metadata.FoundationId,
+					CollectedAt:  metadata.CollectedAt,
+					Dataset:      filepath.Dir(hdr.Name),
+				}
 				messagesInTar = append(messagesInTar, map[string]interface{}{
-					"FoundationId": metadata.FoundationId,
-					"CollectedAt":  metadata.CollectedAt,
-					"Dataset":      filepath.Dir(hdr.Name),
+					"FoundationId": dataset.FoundationId,
+					"CollectedAt":  dataset.CollectedAt,
+					"Dataset":      dataset.Dataset,
 				})
+				datasets = append(datasets, dataset)
 			}
 		}
 	}
 
-	return messagesInTar, nil
+	batchID, err := newBatchID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksum := sha256.Sum256(contents)
+	batch := map[string]interface{}{
+		"Id":                      batchID,
+		"ReceivedAt":              time.Now().UTC().Format(time.RFC3339Nano),
+		"ContentEncoding":         contentEncoding,
+		"DetectedContentEncoding": body.detected,
+		"Size":                    len(contents),
+		"Sha256":                  hex.EncodeToString(checksum[:]),
+		"Entries":                 entries,
+		"Datasets":                datasets,
+	}
+	archive := map[string]interface{}{
+		"Id":              batchID,
+		"ContentEncoding": contentEncoding,
+		"Archive":         base64.StdEncoding.EncodeToString(contents),
+	}
+
+	metadata := &receiverMetadata{ContentEncoding: contentEncoding}
+	if body.detected != encodingIdentity {
+		metadata.DetectedContentEncoding = body.detected
+	}
+	return collectionMessages{
+		batchMessagesCollection: messagesInTar,
+		batchesCollection:       {batch},
+		batchArchivesCollection: {archive},
+	}, metadata, nil
+}
+
+func newBatchID() (string, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate batch id: %w", err)
+	}
+	return id, nil
+}
+
+// newRandomID returns 16 random bytes, hex encoded
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// tarEntryRecord describes a regular file from a batch tarball, including its
+// decoded contents when the file holds valid JSON
+func tarEntryRecord(hdr *tar.Header, fileContents []byte) map[string]interface{} {
+	checksum := sha256.Sum256(fileContents)
+	entry := map[string]interface{}{
+		"Name":   hdr.Name,
+		"Size":   hdr.Size,
+		"Mode":   fmt.Sprintf("%#o", hdr.Mode),
+		"Sha256": hex.EncodeToString(checksum[:]),
+	}
+
+	var decoded interface{}
+	if json.Unmarshal(fileContents, &decoded) == nil {
+		entry["Content"] = decoded
+	}
+	return entry
 }
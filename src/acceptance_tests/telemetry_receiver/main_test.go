@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -35,21 +37,7 @@ var _ = Describe("Main", func() {
 	)
 
 	BeforeEach(func() {
-		var port string
-		var err error
-
-		// Retry the entire port finding and server startup process
-		Eventually(func() bool {
-			port, err = findFreePort()
-			if err != nil {
-				return false
-			}
-
-			session = startServer(binaryPath, port, map[string]string{})
-			return dialLoader(port)
-		}).WithTimeout(15 * time.Second).WithPolling(200 * time.Millisecond).Should(BeTrue())
-
-		serverUrl = fmt.Sprintf("http://127.0.0.1:%s", port)
+		session, serverUrl = startServerAndWait(map[string]string{})
 
 		// Clear any existing messages to ensure test isolation
 		clearMessages(serverUrl)
@@ -435,6 +423,129 @@ var _ = Describe("Main", func() {
 				Expect(messages[len(messages)-1]["FoundationId"]).To(Equal("50"))
 			})
 
+			It("allows retrieval of every file sent in each batch", func() {
+				Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(BeEmpty())
+
+				metadata := []byte(`{"FoundationId": "best-foundation-id", "CollectedAt": "2006-01-02T15:04:05Z07:00"}`)
+				settings := []byte(`{"settings": [{"name": "ntp"}]}`)
+				notes := []byte("not json")
+				resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, gzipContents(tarForEntries(
+					tarEntry{Name: path.Join("opsmanager", "metadata"), Contents: metadata},
+					tarEntry{Name: path.Join("opsmanager", "ops_manager_settings"), Contents: settings},
+					tarEntry{Name: path.Join("opsmanager", "notes.txt"), Contents: notes, Mode: 0600},
+				)))
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+				batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+				Expect(batches).To(HaveLen(1))
+				Expect(batches[0]["ContentEncoding"]).To(Equal("gzip"))
+				Expect(batches[0]["ReceivedAt"]).NotTo(BeEmpty())
+				Expect(batches[0]["Entries"]).To(Equal([]interface{}{
+					map[string]interface{}{
+						"Name":   "opsmanager/metadata",
+						"Size":   float64(len(metadata)),
+						"Mode":   "0644",
+						"Sha256": sha256Hex(metadata),
+						"Content": map[string]interface{}{
+							"FoundationId": "best-foundation-id",
+							"CollectedAt":  "2006-01-02T15:04:05Z07:00",
+						},
+					},
+					map[string]interface{}{
+						"Name":    "opsmanager/ops_manager_settings",
+						"Size":    float64(len(settings)),
+						"Mode":    "0644",
+						"Sha256":  sha256Hex(settings),
+						"Content": map[string]interface{}{"settings": []interface{}{map[string]interface{}{"name": "ntp"}}},
+					},
+					map[string]interface{}{
+						"Name":   "opsmanager/notes.txt",
+						"Size":   float64(len(notes)),
+						"Mode":   "0600",
+						"Sha256": sha256Hex(notes),
+					},
+				}))
+
+				resp = makeRequest(http.MethodGet, fmt.Sprintf("%s/received_batches/%s", serverUrl, batches[0]["Id"]), validTokenContent, nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var batch map[string]interface{}
+				Expect(json.NewDecoder(resp.Body).Decode(&batch)).To(Succeed())
+				Expect(batch).To(Equal(batches[0]))
+
+				resp = makeRequest(http.MethodPost, serverUrl+"/clear_messages", validTokenContent, nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(getMessages(serverUrl+"/received_batches", validTokenContent)).To(BeEmpty())
+			})
+
+			It("returns not found for a batch the user did not send", func() {
+				resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("best-foundation-id", true))
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+				batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+				Expect(batches).To(HaveLen(1))
+
+				resp = makeRequest(http.MethodGet, fmt.Sprintf("%s/received_batches/%s", serverUrl, batches[0]["Id"]), "Bearer second-token", nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+				resp = makeRequest(http.MethodGet, serverUrl+"/received_batches/unknown-id", validTokenContent, nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+
+			DescribeTable("allows download of the original tarball sent in a batch",
+				func(compressed bool, expectedEncoding string) {
+					tarball := generateTarFileContents("best-foundation-id", compressed)
+					resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, compressed, tarball)
+					defer func() { _ = resp.Body.Close() }()
+					Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+					batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+					Expect(batches).To(HaveLen(1))
+					batchID, ok := batches[0]["Id"].(string)
+					Expect(ok).To(BeTrue())
+					Expect(batchID).NotTo(BeEmpty())
+
+					req, err := http.NewRequest(http.MethodGet, serverUrl+"/received_batches/"+batchID+"/archive", nil)
+					Expect(err).NotTo(HaveOccurred())
+					req.Header.Set("Authorization", validTokenContent)
+					// Setting Accept-Encoding stops the client from transparently decompressing the response
+					req.Header.Set("Accept-Encoding", "gzip")
+					resp, err = http.DefaultClient.Do(req)
+					Expect(err).NotTo(HaveOccurred())
+					defer func() { _ = resp.Body.Close() }()
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					Expect(resp.Header.Get("Content-Encoding")).To(Equal(expectedEncoding))
+
+					archive, err := io.ReadAll(resp.Body)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(archive).To(Equal(tarball))
+				},
+				Entry("gzip encoded", true, "gzip"),
+				Entry("uncompressed", false, ""),
+			)
+
+			It("returns not found when downloading a tarball the user did not send", func() {
+				resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("best-foundation-id", true))
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+				batches := getMessages(serverUrl+"/received_batches", validTokenContent)
+				Expect(batches).To(HaveLen(1))
+
+				resp = makeRequest(http.MethodGet, fmt.Sprintf("%s/received_batches/%s/archive", serverUrl, batches[0]["Id"]), "Bearer second-token", nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+				resp = makeRequest(http.MethodGet, serverUrl+"/received_batches/unknown-id/archive", validTokenContent, nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+
 			It("returns an bad request error when the json is invalid format", func() {
 				// Note: This test has historically been flaky. The server may either:
 				// 1. Return StatusBadRequest (expected behavior per HTTP spec)
@@ -507,6 +618,8 @@ var _ = Describe("Main", func() {
 		Entry("/collections/batch", "/collections/batch"),
 		Entry("/received_batch_messages", "/received_batch_messages"),
 		Entry("/received_messages", "/received_messages"),
+		Entry("/received_batches", "/received_batches"),
+		Entry("/received_batches/{id}/archive", "/received_batches/some-id/archive"),
 		Entry("/clear_messages", "/clear_messages"),
 	)
 })
@@ -531,6 +644,32 @@ func startServer(loader, port string, envOverride map[string]string) *gexec.Sess
 	return startServerWithEnv(loader, env)
 }
 
+// startServerAndWait starts the receiver on a free port and waits until it accepts connections
+func startServerAndWait(envOverride map[string]string) (*gexec.Session, string) {
+	var (
+		session *gexec.Session
+		port    string
+		err     error
+	)
+
+	// Retry the entire port finding and server startup process
+	Eventually(func() bool {
+		port, err = findFreePort()
+		if err != nil {
+			return false
+		}
+
+		session = startServer(binaryPath, port, envOverride)
+		if !dialLoader(port) {
+			session.Kill()
+			return false
+		}
+		return true
+	}).WithTimeout(15 * time.Second).WithPolling(200 * time.Millisecond).Should(BeTrue())
+
+	return session, fmt.Sprintf("http://127.0.0.1:%s", port)
+}
+
 func startServerWithEnv(loader string, envMap map[string]string) *gexec.Session {
 	var env []string
 	for k, v := range envMap {
@@ -598,11 +737,17 @@ func findFreePort() (string, error) {
 	return "0", fmt.Errorf("could not find a free port in range 50000-65535")
 }
 
+// dialLoader waits briefly for the receiver to start listening, since the
+// process needs a moment after launch before it accepts connections
 func dialLoader(port string) bool {
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", port))
-	if err == nil {
-		_ = conn.Close()
-		return true
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", port))
+		if err == nil {
+			_ = conn.Close()
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
 	return false
 }
@@ -650,27 +795,75 @@ func generateTarFileContents(foundationId string, compressed bool) []byte {
 }
 
 func gzippedTarForContents(contents []byte, fileName string) []byte {
+	return gzipContents(tarForContents(contents, fileName))
+}
+
+func gzipContents(contents []byte) []byte {
 	buffer := &bytes.Buffer{}
 	writer := gzip.NewWriter(buffer)
-	_, _ = writer.Write(tarForContents(contents, fileName))
+	_, _ = writer.Write(contents)
 	_ = writer.Close()
 
 	return buffer.Bytes()
 }
 
 func tarForContents(contents []byte, fileName string) []byte {
+	return tarForEntries(tarEntry{Name: fileName, Contents: contents})
+}
+
+type tarEntry struct {
+	Name     string
+	Contents []byte
+	Mode     int64
+}
+
+func tarForEntries(entries ...tarEntry) []byte {
 	tarBuffer := bytes.NewBuffer([]byte{})
 	tWriter := tar.NewWriter(tarBuffer)
-	fileHeader := &tar.Header{
-		Name: fileName,
-		Size: int64(len(contents)),
-		Mode: 0644,
+	for _, entry := range entries {
+		mode := entry.Mode
+		if mode == 0 {
+			mode = 0644
+		}
+		fileHeader := &tar.Header{
+			Name: entry.Name,
+			Size: int64(len(entry.Contents)),
+			Mode: mode,
+		}
+		Expect(tWriter.WriteHeader(fileHeader)).To(Succeed())
+		_, err := tWriter.Write(entry.Contents)
+		Expect(err).NotTo(HaveOccurred())
 	}
-	Expect(tWriter.WriteHeader(fileHeader)).To(Succeed())
-	_, err := tWriter.Write(contents)
-	Expect(err).NotTo(HaveOccurred())
 
 	_ = tWriter.Close()
 
 	return tarBuffer.Bytes()
 }
+
+func sha256Hex(contents []byte) string {
+	checksum := sha256.Sum256(contents)
+	return hex.EncodeToString(checksum[:])
+}
+
+func getMessages(url, authHeaderContent string) []map[string]interface{} {
+	resp := makeRequest(http.MethodGet, url, authHeaderContent, nil)
+	defer func() { _ = resp.Body.Close() }()
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	respBody, err := io.ReadAll(resp.Body)
+	Expect(err).NotTo(HaveOccurred())
+	var messages []map[string]interface{}
+	Expect(json.Unmarshal(respBody, &messages)).To(Succeed())
+	return messages
+}
+
+func getMetrics(serverUrl string) string {
+	resp := makeRequest(http.MethodGet, serverUrl+"/metrics", "", nil)
+	defer func() { _ = resp.Body.Close() }()
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	Expect(resp.Header.Get("Content-Type")).To(Equal("application/openmetrics-text; version=1.0.0; charset=utf-8"))
+
+	respBody, err := io.ReadAll(resp.Body)
+	Expect(err).NotTo(HaveOccurred())
+	return string(respBody)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	// forwardEndpoint labels metrics for the Fluentd forward listener, which has no HTTP path
+	forwardEndpoint = "forward"
+)
+
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets     = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+)
+
+// receiverMetrics are the metrics exposed on /metrics in the OpenMetrics text format
+type receiverMetrics struct {
+	requests          *counterVec
+	requestDuration   *histogramVec
+	requestSize       *histogramVec
+	receivedBytes     *counterVec
+	messagesStored    *counterVec
+	parseFailures     *counterVec
+	authFailures      *counterVec
+	evictions         *counterVec
+	configReloads     *counterVec
+	rateLimited       *counterVec
+	duplicates        *counterVec
+	idempotentReplays *counterVec
+
+	families []metricFamily
+}
+
+func newReceiverMetrics() *receiverMetrics {
+	m := &receiverMetrics{
+		requests: newCounterVec("telemetry_receiver_http_requests",
+			"HTTP requests handled, by user, endpoint and status code.", "user", "endpoint", "code"),
+		requestDuration: newHistogramVec("telemetry_receiver_http_request_duration_seconds",
+			"Time taken to handle HTTP requests, by user and endpoint.", durationBuckets, "user", "endpoint"),
+		requestSize: newHistogramVec("telemetry_receiver_http_request_size_bytes",
+			"Size of HTTP request bodies, by user and endpoint.", sizeBuckets, "user", "endpoint"),
+		receivedBytes: newCounterVec("telemetry_receiver_received_bytes",
+			"Bytes of request bodies received, by user and endpoint.", "user", "endpoint"),
+		messagesStored: newCounterVec("telemetry_receiver_messages_stored",
+			"Messages stored, by user and collection. Batches are stored in the batches collection.", "user", "collection"),
+		parseFailures: newCounterVec("telemetry_receiver_parse_failures",
+			"Requests whose messages could not be parsed or violated the telemetry message contract, by user and endpoint.", "user", "endpoint"),
+		authFailures: newCounterVec("telemetry_receiver_auth_failures",
+			"Requests rejected for missing or invalid credentials, or for keys without the scope the endpoint requires, by endpoint.", "endpoint"),
+		evictions: newCounterVec("telemetry_receiver_evictions",
+			"Messages evicted, by user, collection and reason: limit (MESSAGE_LIMIT), ttl (MESSAGE_TTL) or memory_budget (MEMORY_BUDGET).",
+			"user", "collection", "reason"),
+		configReloads: newCounterVec("telemetry_receiver_config_reloads",
+			"Config file reloads, by result: success or failure.", "result"),
+		rateLimited: newCounterVec("telemetry_receiver_rate_limited",
+			"Requests rejected with 429 Too Many Requests by RATE_LIMITS, by user and endpoint.", "user", "endpoint"),
+		duplicates: newCounterVec("telemetry_receiver_duplicate_batches",
+			"Batches that repeat the body or a dataset of an earlier batch, by user and outcome: flagged or rejected (DUPLICATE_BATCHES).",
+			"user", "outcome"),
+		idempotentReplays: newCounterVec("telemetry_receiver_idempotent_replays",
+			"Responses replayed for a repeated Idempotency-Key instead of storing the request's messages again, by user and endpoint.",
+			"user", "endpoint"),
+	}
+	m.families = []metricFamily{
+		m.requests, m.requestDuration, m.requestSize, m.receivedBytes,
+		m.messagesStored, m.parseFailures, m.authFailures, m.evictions, m.configReloads, m.rateLimited,
+		m.duplicates, m.idempotentReplays,
+	}
+	return m
+}
+
+func (m *receiverMetrics) write(w io.Writer) error {
+	for _, family := range m.families {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+type metricFamily interface {
+	write(w io.Writer) error
+}
+
+// metricLabels is shared by the counter and histogram vectors, which keep one series
+// per combination of label values
+type metricLabels struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (l metricLabels) key(labelValues []string) string {
+	if len(labelValues) != len(l.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", l.name, len(l.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func (l metricLabels) writeHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", l.name, metricType, l.name, l.help)
+	return err
+}
+
+// format renders label names and values, with an optional extra label, as {name="value",...}
+func (l metricLabels) format(labelValues []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range l.labelNames {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(labelValues[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelValueEscaper.Replace(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type counterVec struct {
+	metricLabels
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		metricLabels: metricLabels{name: name, help: help, labelNames: labelNames},
+		series:       map[string]*counterSeries{},
+	}
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{labelValues: labelValues}
+		c.series[key] = series
+	}
+	series.value += value
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(c.series) {
+		series := c.series[key]
+		_, err := fmt.Fprintf(w, "%s_total%s %s\n", c.name, c.format(series.labelValues, "", ""), formatFloat(series.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogramVec struct {
+	metricLabels
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// bucketCounts holds the number of observations in each bucket, not cumulatively
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		metricLabels: metricLabels{name: name, help: help, labelNames: labelNames},
+		buckets:      buckets,
+		series:       map[string]*histogramSeries{},
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.bucketCounts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += series.bucketCounts[i]
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(series.labelValues, "le", formatFloat(upperBound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.format(series.labelValues, "le", "+Inf"), series.count,
+			h.name, h.format(series.labelValues, "", ""), formatFloat(series.sum),
+			h.name, h.format(series.labelValues, "", ""), series.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", openMetricsContentType)
+	if err := metrics.write(w); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
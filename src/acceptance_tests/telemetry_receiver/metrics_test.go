@@ -0,0 +1,76 @@
+package main_test
+
+import (
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{MessageLimitEnvVar: "2"})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("exposes request, storage and failure metrics per user and endpoint", func() {
+		body := generateTelemetryMsg()
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, body)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, body)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, []byte("not json"))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		resp = makeBatchRequest(http.MethodPost, serverUrl, "Bearer second-token", true, generateTarFileContents("some-foundation", true))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		resp = makeRequest(http.MethodGet, serverUrl+"/received_messages", "Bearer bad-token", nil)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		metrics := getMetrics(serverUrl)
+		Expect(metrics).To(ContainSubstring("# TYPE telemetry_receiver_http_requests counter\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_requests_total{user="user-id",endpoint="/components",code="201"} 2` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_requests_total{user="user-id",endpoint="/components",code="400"} 1` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_requests_total{user="user-id2",endpoint="/collections/batch",code="201"} 1` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_requests_total{user="",endpoint="/received_messages",code="401"} 1` + "\n"))
+
+		Expect(metrics).To(ContainSubstring("# TYPE telemetry_receiver_http_request_duration_seconds histogram\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_request_duration_seconds_bucket{user="user-id",endpoint="/components",le="+Inf"} 3` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_request_duration_seconds_count{user="user-id",endpoint="/components"} 3` + "\n"))
+
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_received_bytes_total{user="user-id",endpoint="/components"} %d`+"\n", 2*len(body)+len("not json")))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_http_request_size_bytes_count{user="user-id",endpoint="/components"} 3` + "\n"))
+
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_messages_stored_total{user="user-id",collection="messages"} 4` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_messages_stored_total{user="user-id2",collection="batch_messages"} 1` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_messages_stored_total{user="user-id2",collection="batches"} 1` + "\n"))
+		Expect(metrics).NotTo(ContainSubstring(`collection="batch_archives"`))
+
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_parse_failures_total{user="user-id",endpoint="/components"} 1` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_auth_failures_total{endpoint="/received_messages"} 1` + "\n"))
+		Expect(metrics).To(ContainSubstring(`telemetry_receiver_evictions_total{user="user-id",collection="messages",reason="limit"} 2` + "\n"))
+
+		Expect(metrics).To(HaveSuffix("# EOF\n"))
+	})
+})
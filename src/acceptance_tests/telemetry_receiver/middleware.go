@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RequestIDHeader identifies a request in the receiver's request log. It is taken from
+	// the request when the client sets it and echoed in the response.
+	RequestIDHeader = "X-Request-Id"
+
+	maxRequestIDLength = 128
+
+	parseOutcomeParsed            = "parsed"
+	parseOutcomeInvalid           = "invalid"
+	parseOutcomeContractViolation = "contract_violation"
+	parseOutcomeTooLarge          = "too_large"
+)
+
+// requestLogger writes one JSON line per request to stdout, separately from the
+// free-form log lines handlers write to stderr
+var requestLogger = log.New(os.Stdout, "", 0)
+
+// requestLogEntry is the JSON line logged for each request
+type requestLogEntry struct {
+	Time            string  `json:"time"`
+	RequestID       string  `json:"request_id"`
+	Method          string  `json:"method"`
+	Path            string  `json:"path"`
+	User            string  `json:"user"`
+	Status          int     `json:"status"`
+	DurationMs      float64 `json:"duration_ms"`
+	RequestBodySize int64   `json:"request_body_bytes"`
+	ContentEncoding string  `json:"content_encoding,omitempty"`
+	ParseOutcome    string  `json:"parse_outcome,omitempty"`
+}
+
+type requestDetailsKey struct{}
+
+// requestDetails collects what handlers learn about a request for its log entry
+type requestDetails struct {
+	// endpoint is the path of the pattern the request matched, as labelled in /metrics
+	endpoint     string
+	parseOutcome string
+}
+
+// setParseOutcome records whether an ingestion request's messages could be parsed
+func setParseOutcome(r *http.Request, outcome string) {
+	if details, ok := r.Context().Value(requestDetailsKey{}).(*requestDetails); ok {
+		details.parseOutcome = outcome
+	}
+}
+
+// handleFunc registers a handler on the default mux, logging its requests and
+// recording metrics for them under the pattern's path
+func handleFunc(pattern string, handler http.HandlerFunc) {
+	endpoint := pattern
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		endpoint = path
+	}
+	http.HandleFunc(pattern, instrumented(endpoint, handler))
+}
+
+func instrumented(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		owner, failure := authenticated(r.Header)
+		userID := owner.userID
+
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			var err error
+			if requestID, err = newRandomID(); err != nil {
+				log.Printf("Error generating request id: %v", err)
+			}
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		details := &requestDetails{endpoint: endpoint}
+		r = r.WithContext(context.WithValue(r.Context(), requestDetailsKey{}, details))
+		r = withRequestAuth(r, owner, failure)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		handler(recorder, r)
+
+		duration := time.Since(start)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metrics.requests.inc(userID, endpoint, strconv.Itoa(status))
+		metrics.requestDuration.observe(duration.Seconds(), userID, endpoint)
+		bodySize := requestBodySize(r, body)
+		if bodySize > 0 {
+			metrics.requestSize.observe(float64(bodySize), userID, endpoint)
+		}
+		if body.bytesRead > 0 {
+			metrics.receivedBytes.add(float64(body.bytesRead), userID, endpoint)
+		}
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			metrics.authFailures.inc(endpoint)
+		}
+
+		logRequest(requestLogEntry{
+			Time:            start.UTC().Format(time.RFC3339Nano),
+			RequestID:       requestID,
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			User:            userID,
+			Status:          status,
+			DurationMs:      float64(duration.Microseconds()) / 1000,
+			RequestBodySize: bodySize,
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+			ParseOutcome:    details.parseOutcome,
+		})
+	}
+}
+
+// requestBodySize returns the size of the request body from its Content-Length, which is known
+// even when the request is rejected before its body is read, or otherwise the bytes the handler
+// read from a chunked body
+func requestBodySize(r *http.Request, body *countingReader) int64 {
+	if r.ContentLength >= 0 {
+		return r.ContentLength
+	}
+	return body.bytesRead
+}
+
+// requestEndpoint returns the endpoint the request is labelled with in /metrics
+func requestEndpoint(r *http.Request) string {
+	if details, ok := r.Context().Value(requestDetailsKey{}).(*requestDetails); ok {
+		return details.endpoint
+	}
+	return r.URL.Path
+}
+
+// validRequestID accepts client request IDs that can be logged and echoed safely
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func logRequest(entry requestLogEntry) {
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling request log entry for request %s: %v", entry.RequestID, err)
+		return
+	}
+	requestLogger.Println(string(entryBytes))
+}
+
+// responseRecorder wraps a ResponseWriter to capture the status code the handler responded with
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets the /stream handler flush events through the recorder
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countingReader counts the bytes a handler reads from a request body
+type countingReader struct {
+	io.ReadCloser
+	bytesRead int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytesRead += int64(n)
+	return n, err
+}
@@ -0,0 +1,132 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Request logging", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(nil)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	// requestLogEntry waits for the request log line with the given request ID
+	requestLogEntry := func(requestID string) map[string]interface{} {
+		var entry map[string]interface{}
+		Eventually(func() bool {
+			for _, line := range bytes.Split(session.Out.Contents(), []byte("\n")) {
+				entry = nil
+				if json.Unmarshal(line, &entry) == nil && entry["request_id"] == requestID {
+					return true
+				}
+			}
+			return false
+		}).WithTimeout(5 * time.Second).Should(BeTrue())
+		return entry
+	}
+
+	sendWithRequestID := func(url, requestID, contentEncoding string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", validTokenContent)
+		if requestID != "" {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("propagates the client's request ID and logs the request as a JSON line", func() {
+		body := generateTelemetryMsg()
+		resp := sendWithRequestID(serverUrl+"/components", "collector-request-1", "", body)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(RequestIDHeader)).To(Equal("collector-request-1"))
+
+		entry := requestLogEntry("collector-request-1")
+		Expect(entry).To(HaveKeyWithValue("method", "POST"))
+		Expect(entry).To(HaveKeyWithValue("path", "/components"))
+		Expect(entry).To(HaveKeyWithValue("user", "user-id"))
+		Expect(entry).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusCreated)))
+		Expect(entry).To(HaveKeyWithValue("request_body_bytes", BeNumerically("==", len(body))))
+		Expect(entry).To(HaveKeyWithValue("parse_outcome", "parsed"))
+		Expect(entry).To(HaveKey("duration_ms"))
+		Expect(entry).To(HaveKey("time"))
+		Expect(entry).NotTo(HaveKey("content_encoding"))
+	})
+
+	It("logs the content encoding and parse failures of batch requests", func() {
+		resp := sendWithRequestID(serverUrl+"/collections/batch", "collector-request-2", "gzip", []byte("not gzip"))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		entry := requestLogEntry("collector-request-2")
+		Expect(entry).To(HaveKeyWithValue("content_encoding", "gzip"))
+		Expect(entry).To(HaveKeyWithValue("parse_outcome", "invalid"))
+		Expect(entry).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusBadRequest)))
+	})
+
+	It("assigns a request ID when the client does not send a usable one", func() {
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", validTokenContent, nil)
+		_ = resp.Body.Close()
+		requestID := resp.Header.Get(RequestIDHeader)
+		Expect(requestID).To(MatchRegexp("^[0-9a-f]{32}$"))
+
+		entry := requestLogEntry(requestID)
+		Expect(entry).To(HaveKeyWithValue("path", "/received_messages"))
+		Expect(entry).NotTo(HaveKey("parse_outcome"))
+
+		resp = sendWithRequestID(serverUrl+"/components", strings.Repeat("x", 200), "", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.Header.Get(RequestIDHeader)).To(MatchRegexp("^[0-9a-f]{32}$"))
+	})
+
+	It("logs rejected requests without a user", func() {
+		body := generateTelemetryMsg()
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer bad-token", body)
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		entry := requestLogEntry(resp.Header.Get(RequestIDHeader))
+		Expect(entry).To(HaveKeyWithValue("user", ""))
+		Expect(entry).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusUnauthorized)))
+		Expect(entry).To(HaveKeyWithValue("request_body_bytes", BeNumerically("==", len(body))))
+	})
+
+	DescribeTable("logs requests to the endpoints that need no key",
+		func(path string) {
+			resp := makeRequest(http.MethodGet, serverUrl+path, "", nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			entry := requestLogEntry(resp.Header.Get(RequestIDHeader))
+			Expect(entry).To(HaveKeyWithValue("path", path))
+			Expect(entry).To(HaveKeyWithValue("status", BeNumerically("==", http.StatusOK)))
+		},
+		Entry("/up", "/up"),
+		Entry("/metrics", "/metrics"),
+	)
+})
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	sourceQueryParam       = "source"
+	foundationIDQueryParam = "foundation_id"
+	datasetQueryParam      = "dataset"
+	sinceQueryParam        = "since"
+	untilQueryParam        = "until"
+	limitQueryParam        = "limit"
+	cursorQueryParam       = "cursor"
+	metadataQueryParam     = "metadata"
+
+	// NextCursorHeader carries the cursor for the next page of results when a limit cut the response short
+	NextCursorHeader = "X-Next-Cursor"
+
+	cursorPrefix = "position:"
+)
+
+// queryFields names the message fields that each filter query parameter applies to
+// in a collection. Filters with no field are not supported for the collection.
+type queryFields struct {
+	fieldParams map[string]string
+	timeField   string
+}
+
+var collectionQueryFields = map[string]queryFields{
+	messagesCollection: {
+		fieldParams: map[string]string{
+			sourceQueryParam:       "telemetry-source",
+			foundationIDQueryParam: "telemetry-foundation-id",
+		},
+		timeField: "telemetry-time",
+	},
+	batchMessagesCollection: {
+		fieldParams: map[string]string{
+			foundationIDQueryParam: "FoundationId",
+			datasetQueryParam:      "Dataset",
+		},
+		timeField: "CollectedAt",
+	},
+	batchesCollection: {
+		timeField: "ReceivedAt",
+	},
+}
+
+// messageQuery filters and paginates the messages read from a collection
+type messageQuery struct {
+	// fieldValues maps message fields to the value they must equal
+	fieldValues map[string]string
+	timeField   string
+	// since is inclusive and until is exclusive; zero values leave the range open
+	since time.Time
+	until time.Time
+	// limit is the maximum number of messages returned, or zero for no limit
+	limit int
+	// position is where reading starts in the sequence of messages appended to the collection
+	position int
+	// withMetadata returns each message in an envelope along with its receiver metadata
+	withMetadata bool
+}
+
+func parseMessageQuery(collection string, params url.Values) (messageQuery, error) {
+	fields := collectionQueryFields[collection]
+	query := messageQuery{
+		fieldValues: map[string]string{},
+		timeField:   fields.timeField,
+	}
+
+	for _, param := range []string{sourceQueryParam, foundationIDQueryParam, datasetQueryParam} {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+		field, ok := fields.fieldParams[param]
+		if !ok {
+			return messageQuery{}, fmt.Errorf("%s is not supported by this endpoint", param)
+		}
+		query.fieldValues[field] = value
+	}
+
+	var err error
+	if query.since, err = parseTimeParam(params, sinceQueryParam); err != nil {
+		return messageQuery{}, err
+	}
+	if query.until, err = parseTimeParam(params, untilQueryParam); err != nil {
+		return messageQuery{}, err
+	}
+
+	if value := params.Get(limitQueryParam); value != "" {
+		query.limit, err = strconv.Atoi(value)
+		if err != nil || query.limit < 1 {
+			return messageQuery{}, fmt.Errorf("%s must be a positive integer", limitQueryParam)
+		}
+	}
+
+	if value := params.Get(cursorQueryParam); value != "" {
+		query.position, err = decodeCursor(value)
+		if err != nil {
+			return messageQuery{}, err
+		}
+	}
+
+	if value := params.Get(metadataQueryParam); value != "" {
+		query.withMetadata, err = strconv.ParseBool(value)
+		if err != nil {
+			return messageQuery{}, fmt.Errorf("%s must be true or false", metadataQueryParam)
+		}
+	}
+
+	return query, nil
+}
+
+func parseTimeParam(params url.Values, param string) (time.Time, error) {
+	value := params.Get(param)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be in date/time format RFC 3339", param)
+	}
+	return t, nil
+}
+
+func (q messageQuery) matches(message map[string]interface{}) bool {
+	for field, value := range q.fieldValues {
+		if getString(message, field, "") != value {
+			return false
+		}
+	}
+
+	if q.since.IsZero() && q.until.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, getString(message, q.timeField, ""))
+	if err != nil {
+		return false
+	}
+	if !q.since.IsZero() && t.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !t.Before(q.until) {
+		return false
+	}
+	return true
+}
+
+// page returns the matching messages from the query's position onwards, up to its
+// limit, along with a cursor for the next page if the limit was reached first
+func (q messageQuery) page(stored storedMessages) ([]map[string]interface{}, string) {
+	// Messages before the position may since have been evicted
+	start := q.position - stored.Evicted
+	if start < 0 {
+		start = 0
+	}
+
+	matched := []map[string]interface{}{}
+	for i := start; i < len(stored.Messages); i++ {
+		if !q.matches(stored.Messages[i]) {
+			continue
+		}
+		if q.limit > 0 && len(matched) == q.limit {
+			return matched, encodeCursor(stored.Evicted + i)
+		}
+		if q.withMetadata {
+			matched = append(matched, messageEnvelope(stored.Messages[i], stored.Metadata[i]))
+		} else {
+			matched = append(matched, stored.Messages[i])
+		}
+	}
+	return matched, ""
+}
+
+// messageEnvelope holds a message as it was sent under "message", next to the metadata the
+// receiver recorded about the request that carried it under "receiver"
+func messageEnvelope(message map[string]interface{}, metadata *receiverMetadata) map[string]interface{} {
+	if metadata == nil {
+		metadata = &receiverMetadata{}
+	}
+	return map[string]interface{}{"message": message, "receiver": metadata}
+}
+
+func encodeCursor(position int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(position)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	errInvalidCursor := errors.New("cursor is invalid")
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(decoded) <= len(cursorPrefix) || string(decoded[:len(cursorPrefix)]) != cursorPrefix {
+		return 0, errInvalidCursor
+	}
+	position, err := strconv.Atoi(string(decoded[len(cursorPrefix):]))
+	if err != nil || position < 0 {
+		return 0, errInvalidCursor
+	}
+	return position, nil
+}
@@ -0,0 +1,184 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Filtering and pagination", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{MessageLimitEnvVar: "5"})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	Describe("/received_messages", func() {
+		BeforeEach(func() {
+			postComponentMessages(serverUrl,
+				componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"),
+				componentMsg("source-b", "foundation-1", "2009-11-10T23:30:00Z"),
+				componentMsg("source-a", "foundation-2", "2009-11-11T00:00:00Z"),
+				`{"telemetry-source": "source-a", "telemetry-foundation-id": "foundation-1"}`,
+			)
+		})
+
+		It("filters by source and foundation id", func() {
+			messages := getMessages(serverUrl+"/received_messages?source=source-a", validTokenContent)
+			Expect(messages).To(HaveLen(3))
+
+			messages = getMessages(serverUrl+"/received_messages?source=source-a&foundation_id=foundation-1", validTokenContent)
+			Expect(messages).To(HaveLen(2))
+			for _, message := range messages {
+				Expect(message["telemetry-source"]).To(Equal("source-a"))
+				Expect(message["telemetry-foundation-id"]).To(Equal("foundation-1"))
+			}
+		})
+
+		It("filters by telemetry-time, including since and excluding until", func() {
+			messages := getMessages(serverUrl+"/received_messages?"+url.Values{
+				"since": {"2009-11-10T23:30:00Z"},
+				"until": {"2009-11-11T00:00:00Z"},
+			}.Encode(), validTokenContent)
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0]["telemetry-time"]).To(Equal("2009-11-10T23:30:00Z"))
+
+			messages = getMessages(serverUrl+"/received_messages?"+url.Values{
+				"since": {"2009-11-11T01:30:00+02:00"},
+			}.Encode(), validTokenContent)
+			Expect(messages).To(HaveLen(2))
+		})
+
+		It("pages through messages with a cursor", func() {
+			var times []interface{}
+			nextUrl := serverUrl + "/received_messages?foundation_id=foundation-1&limit=2"
+			pages := 0
+			for nextUrl != "" {
+				messages, cursor := getMessagesPage(nextUrl)
+				pages++
+				for _, message := range messages {
+					times = append(times, message["telemetry-time"])
+				}
+				nextUrl = ""
+				if cursor != "" {
+					nextUrl = serverUrl + "/received_messages?foundation_id=foundation-1&limit=2&cursor=" + cursor
+				}
+			}
+
+			Expect(pages).To(Equal(2))
+			Expect(times).To(Equal([]interface{}{"2009-11-10T23:00:00Z", "2009-11-10T23:30:00Z", nil}))
+		})
+
+		It("does not return a cursor when the last page is full", func() {
+			messages, cursor := getMessagesPage(serverUrl + "/received_messages?limit=4")
+			Expect(messages).To(HaveLen(4))
+			Expect(cursor).To(BeEmpty())
+		})
+
+		It("resumes from the oldest retained message when the cursor points to evicted messages", func() {
+			_, cursor := getMessagesPage(serverUrl + "/received_messages?limit=1")
+			Expect(cursor).NotTo(BeEmpty())
+
+			postComponentMessages(serverUrl,
+				componentMsg("source-c", "foundation-3", "2009-11-12T00:00:00Z"),
+				componentMsg("source-c", "foundation-3", "2009-11-12T01:00:00Z"),
+				componentMsg("source-c", "foundation-3", "2009-11-12T02:00:00Z"),
+			)
+
+			messages, _ := getMessagesPage(serverUrl + "/received_messages?limit=1&cursor=" + cursor)
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0]["telemetry-time"]).To(Equal("2009-11-11T00:00:00Z"))
+		})
+
+		DescribeTable("rejects invalid queries",
+			func(query, expectedError string) {
+				resp := makeRequest(http.MethodGet, serverUrl+"/received_messages?"+query, validTokenContent, nil)
+				defer func() { _ = resp.Body.Close() }()
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+				respBody, err := io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(respBody)).To(ContainSubstring(expectedError))
+			},
+			Entry("unsupported filter", "dataset=opsmanager", "dataset is not supported by this endpoint"),
+			Entry("invalid since", "since=yesterday", "since must be in date/time format RFC 3339"),
+			Entry("invalid until", "until=2009-11-10", "until must be in date/time format RFC 3339"),
+			Entry("zero limit", "limit=0", "limit must be a positive integer"),
+			Entry("non-numeric limit", "limit=ten", "limit must be a positive integer"),
+			Entry("malformed cursor", "cursor=not-a-cursor", "cursor is invalid"),
+		)
+	})
+
+	Describe("/received_batch_messages", func() {
+		BeforeEach(func() {
+			resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, false, tarForEntries(
+				tarEntry{Name: "opsmanager/metadata", Contents: []byte(`{"FoundationId": "foundation-1", "CollectedAt": "2009-11-10T23:00:00Z"}`)},
+				tarEntry{Name: "usage_service/metadata", Contents: []byte(`{"FoundationId": "foundation-1", "CollectedAt": "2009-11-11T23:00:00Z"}`)},
+				tarEntry{Name: "opsmanager/metadata", Contents: []byte(`{"FoundationId": "foundation-2", "CollectedAt": "2009-11-12T23:00:00Z"}`)},
+			))
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+
+		It("filters by foundation id, dataset and CollectedAt", func() {
+			Expect(getMessages(serverUrl+"/received_batch_messages?foundation_id=foundation-1", validTokenContent)).To(HaveLen(2))
+			Expect(getMessages(serverUrl+"/received_batch_messages?dataset=opsmanager", validTokenContent)).To(HaveLen(2))
+
+			messages := getMessages(serverUrl+"/received_batch_messages?dataset=opsmanager&since=2009-11-11T00:00:00Z", validTokenContent)
+			Expect(messages).To(ConsistOf(map[string]interface{}{
+				"FoundationId": "foundation-2",
+				"CollectedAt":  "2009-11-12T23:00:00Z",
+				"Dataset":      "opsmanager",
+			}))
+		})
+
+		It("rejects filters on telemetry message fields", func() {
+			resp := makeRequest(http.MethodGet, serverUrl+"/received_batch_messages?source=my-component", validTokenContent, nil)
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
+
+func componentMsg(source, foundationId, telemetryTime string) string {
+	return fmt.Sprintf(`{"telemetry-source": %q, "telemetry-foundation-id": %q, "telemetry-time": %q}`, source, foundationId, telemetryTime)
+}
+
+func postComponentMessages(serverUrl string, messages ...string) {
+	var body []byte
+	for _, message := range messages {
+		body = append(body, message+"\n"...)
+	}
+	resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, body)
+	defer func() { _ = resp.Body.Close() }()
+	Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+}
+
+func getMessagesPage(url string) ([]map[string]interface{}, string) {
+	resp := makeRequest(http.MethodGet, url, validTokenContent, nil)
+	defer func() { _ = resp.Body.Close() }()
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+	respBody, err := io.ReadAll(resp.Body)
+	Expect(err).NotTo(HaveOccurred())
+	var messages []map[string]interface{}
+	Expect(json.Unmarshal(respBody, &messages)).To(Succeed())
+	return messages, resp.Header.Get(NextCursorHeader)
+}
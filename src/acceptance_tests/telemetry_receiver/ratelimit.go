@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// anyEndpoint is the RATE_LIMITS entry that applies to endpoints without an entry of their own
+	anyEndpoint = "*"
+
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// rateLimit is a token bucket: a key may send burst requests at once, and then rate requests per second
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// rateLimits are the rate limits of each endpoint, keyed by the endpoint's path as labelled in
+// /metrics, or by anyEndpoint
+type rateLimits map[string]rateLimit
+
+func parseRateLimits(source configSource) (rateLimits, error) {
+	value := source.get(RateLimitsEnvVar)
+	if value == "" {
+		return nil, nil
+	}
+
+	var limits rateLimits
+	if err := json.Unmarshal([]byte(value), &limits); err != nil {
+		return nil, fmt.Errorf("%s: %w", RateLimitsEnvVar, err)
+	}
+	for endpoint, limit := range limits {
+		if endpoint != anyEndpoint && !strings.HasPrefix(endpoint, "/") {
+			return nil, fmt.Errorf("%s: endpoint %q must be a path or %s", RateLimitsEnvVar, endpoint, anyEndpoint)
+		}
+		if !(limit.Rate > 0) || math.IsInf(limit.Rate, 0) {
+			return nil, fmt.Errorf("%s: rate for %s must be a positive number of requests per second", RateLimitsEnvVar, endpoint)
+		}
+		if limit.Burst < 1 {
+			return nil, fmt.Errorf("%s: burst for %s must be at least 1", RateLimitsEnvVar, endpoint)
+		}
+	}
+	return limits, nil
+}
+
+func (l rateLimits) forEndpoint(endpoint string) (rateLimit, bool) {
+	if limit, ok := l[endpoint]; ok {
+		return limit, true
+	}
+	limit, ok := l[anyEndpoint]
+	return limit, ok
+}
+
+type tokenBucket struct {
+	limit   rateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens earned since the bucket was last refilled, up to its burst
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// take takes a token from the bucket if there is one
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// untilTokens returns how long until the bucket holds the given number of tokens
+func (b *tokenBucket) untilTokens(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+type bucketKey struct {
+	fingerprint string
+	endpoint    string
+}
+
+// rateLimiter keeps a token bucket for each API key and endpoint. Buckets pick up changes to
+// RATE_LIMITS when the config is reloaded, keeping the tokens they hold up to the new burst.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[bucketKey]*tokenBucket{}}
+}
+
+// allow takes a token from the bucket of the key and endpoint, setting the X-RateLimit headers
+// on the response, and responds with 429 Too Many Requests when the bucket is empty
+func (l *rateLimiter) allow(w http.ResponseWriter, owner keyOwner, endpoint string) bool {
+	limit, ok := currentConfig().rateLimits.forEndpoint(endpoint)
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	key := bucketKey{fingerprint: owner.fingerprint, endpoint: endpoint}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = bucket
+	} else if bucket.limit != limit {
+		bucket.refill(now)
+		bucket.limit = limit
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens)
+	}
+	allowed := bucket.take(now)
+	remaining := int(bucket.tokens)
+	reset := bucket.untilTokens(float64(limit.Burst))
+	retryAfter := bucket.untilTokens(1)
+	l.mu.Unlock()
+
+	w.Header().Set(RateLimitLimitHeader, strconv.Itoa(limit.Burst))
+	w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(remaining))
+	w.Header().Set(RateLimitResetHeader, strconv.Itoa(ceilSeconds(reset)))
+	if allowed {
+		return true
+	}
+
+	metrics.rateLimited.inc(owner.userID, endpoint)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(retryAfter))))
+	writeJSONError(w, http.StatusTooManyRequests,
+		fmt.Sprintf("rate limit of %g requests per second with a burst of %d exceeded", limit.Rate, limit.Burst))
+	return false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
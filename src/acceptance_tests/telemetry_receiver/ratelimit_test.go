@@ -0,0 +1,168 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{RateLimitsEnvVar: `{"/components": {"rate": 0.1, "burst": 2}}`}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	post := func(authHeaderContent string) *http.Response {
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", authHeaderContent, generateTelemetryMsg())
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	It("throttles each key once its burst is used up", func() {
+		resp := post(validTokenContent)
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(RateLimitLimitHeader)).To(Equal("2"))
+		Expect(resp.Header.Get(RateLimitRemainingHeader)).To(Equal("1"))
+
+		resp = post(validTokenContent)
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(resp.Header.Get(RateLimitRemainingHeader)).To(Equal("0"))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(resp.Header.Get(RateLimitRemainingHeader)).To(Equal("0"))
+		Expect(strconv.Atoi(resp.Header.Get("Retry-After"))).To(BeNumerically(">=", 9))
+		Expect(strconv.Atoi(resp.Header.Get(RateLimitResetHeader))).To(BeNumerically(">=", 19))
+		var body map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body["error"]).To(ContainSubstring("rate limit"))
+
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(4))
+		Expect(post("Bearer second-token").StatusCode).To(Equal(http.StatusCreated))
+	})
+
+	It("counts throttled requests per user", func() {
+		for i := 0; i < 4; i++ {
+			post(validTokenContent)
+		}
+
+		resp := makeRequest(http.MethodGet, serverUrl+"/metrics", "", nil)
+		defer func() { _ = resp.Body.Close() }()
+		metrics, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metrics)).To(ContainSubstring(`telemetry_receiver_rate_limited_total{user="user-id",endpoint="/components"} 2` + "\n"))
+	})
+
+	It("leaves other endpoints and unauthenticated requests alone", func() {
+		for i := 0; i < 3; i++ {
+			resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", validTokenContent, nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get(RateLimitLimitHeader)).To(BeEmpty())
+
+			Expect(post("Bearer wrong-token").StatusCode).To(Equal(http.StatusUnauthorized))
+		}
+	})
+
+	Context("with a key that lacks an endpoint's scope", func() {
+		BeforeEach(func() {
+			envs[ApiKeysEnvVar] = `{"user-id": ["1234", {"key": "ingest-only", "scopes": ["ingest"]}]}`
+			envs[RateLimitsEnvVar] = `{"*": {"rate": 0.1, "burst": 1}}`
+		})
+
+		It("rejects it as forbidden without using up its rate limit", func() {
+			for i := 0; i < 3; i++ {
+				resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", "Bearer ingest-only", nil)
+				_ = resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Expect(resp.Header.Get(RateLimitLimitHeader)).To(BeEmpty())
+			}
+			Expect(post("Bearer ingest-only").StatusCode).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Context("with a default limit that refills quickly", func() {
+		BeforeEach(func() {
+			envs[RateLimitsEnvVar] = `{"*": {"rate": 10, "burst": 1}}`
+		})
+
+		It("allows requests again once tokens are earned", func() {
+			statusFor := func() int {
+				resp := makeRequest(http.MethodGet, serverUrl+"/received_messages", validTokenContent, nil)
+				_ = resp.Body.Close()
+				return resp.StatusCode
+			}
+			Expect(statusFor()).To(Equal(http.StatusOK))
+			Expect(statusFor()).To(Equal(http.StatusTooManyRequests))
+			Eventually(statusFor).WithTimeout(time.Second).Should(Equal(http.StatusOK))
+		})
+	})
+
+	Context("with a config file", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configPath = filepath.Join(GinkgoT().TempDir(), "config.yml")
+			Expect(os.WriteFile(configPath, []byte("{}"), 0600)).To(Succeed())
+			envs = map[string]string{ConfigFileEnvVar: configPath}
+		})
+
+		It("applies reloaded limits", func() {
+			Expect(post(validTokenContent).StatusCode).To(Equal(http.StatusCreated))
+
+			Expect(os.WriteFile(configPath, []byte(`
+rate_limits:
+  /components: {rate: 0.1, burst: 1}
+`), 0600)).To(Succeed())
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("Reloaded config file"))
+
+			Expect(post(validTokenContent).StatusCode).To(Equal(http.StatusCreated))
+			Expect(post(validTokenContent).StatusCode).To(Equal(http.StatusTooManyRequests))
+		})
+	})
+
+	DescribeTable("when the rate limits are invalid, it exits nonzero",
+		func(rateLimits string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar: "50",
+				RateLimitsEnvVar:   rateLimits,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidRateLimitError + ": " + RateLimitsEnvVar))
+		},
+		Entry("not JSON", `fast`),
+		Entry("not a path", `{"components": {"rate": 1, "burst": 1}}`),
+		Entry("without a rate", `{"/components": {"burst": 1}}`),
+		Entry("without a burst", `{"/components": {"rate": 1}}`),
+	)
+})
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeNDJSON  = "application/x-ndjson"
+	contentTypeJSONSeq = "application/json-seq"
+
+	// recordSeparator starts every record of an RFC 7464 JSON text sequence
+	recordSeparator = 0x1e
+)
+
+// jsonRecord is a message sent to /components, along with the line it starts on
+type jsonRecord struct {
+	message map[string]interface{}
+	line    int
+}
+
+// recordError is returned for the first record of a /components body that is not valid
+// JSON or not a JSON object, and is the body of the 400 Bad Request response
+type recordError struct {
+	Line int `json:"line"`
+	// Index is the position of the record among the elements of a JSON array or the records
+	// of a JSON text sequence, counting from zero, and is left out for other records
+	Index  *int   `json:"index,omitempty"`
+	Reason string `json:"error"`
+}
+
+func (e *recordError) Error() string {
+	if e.Index != nil {
+		return fmt.Sprintf("record %d on line %d: %s", *e.Index, e.Line, e.Reason)
+	}
+	return fmt.Sprintf("record on line %d: %s", e.Line, e.Reason)
+}
+
+// parseJSONRecords parses a /components body according to its Content-Type: a single object
+// or array of objects for application/json, one object per line for application/x-ndjson
+// and a JSON text sequence for application/json-seq. Any other Content-Type, including the
+// centralizer's application/x-telemetry-json-batch, is read as concatenated objects or arrays
+// of objects.
+func parseJSONRecords(contents []byte, contentType string) ([]jsonRecord, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case contentTypeJSON:
+		return parseJSONValues(contents, 0, contents, false, nil)
+	case contentTypeNDJSON:
+		return parseNDJSON(contents)
+	case contentTypeJSONSeq:
+		return parseJSONSeq(contents)
+	default:
+		return parseJSONValues(contents, 0, contents, true, nil)
+	}
+}
+
+// lineNumberAt returns the line on which the first JSON value at or after offset starts,
+// skipping the comma before an element of an array
+func lineNumberAt(contents []byte, offset int64) int {
+	start := int(offset)
+	for start < len(contents) && strings.ContainsRune(" \t\r\n,", rune(contents[start])) {
+		start++
+	}
+	return bytes.Count(contents[:start], []byte("\n")) + 1
+}
+
+// parseJSONValues parses the JSON values in text, which starts at offset start of contents,
+// and fails if there is more than one value unless multiple is set
+func parseJSONValues(contents []byte, start int64, text []byte, multiple bool, index *int) ([]jsonRecord, error) {
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	var records []jsonRecord
+	for values := 0; ; values++ {
+		valueStart := start + decoder.InputOffset()
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, syntaxRecordError(contents, start, start+int64(len(text)), err, index)
+		}
+		if values > 0 && !multiple {
+			return nil, &recordError{
+				Line:   lineNumberAt(contents, valueStart),
+				Index:  index,
+				Reason: "unexpected JSON value after the end of the document",
+			}
+		}
+
+		valueRecords, err := parseJSONValue(contents, valueStart, value, index)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, valueRecords...)
+	}
+}
+
+// parseJSONValue returns the object, or the objects in the array, that starts at or after
+// offset start of contents
+func parseJSONValue(contents []byte, start int64, value json.RawMessage, index *int) ([]jsonRecord, error) {
+	if value[0] != '[' {
+		record, err := parseJSONObject(contents, start, value, index)
+		if err != nil {
+			return nil, err
+		}
+		return []jsonRecord{record}, nil
+	}
+
+	// The array was already decoded once, so it is valid JSON
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	arrayStart := start + int64(bytes.IndexByte(contents[start:], '['))
+	var records []jsonRecord
+	for i := 0; decoder.More(); i++ {
+		elementStart := arrayStart + decoder.InputOffset()
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			return nil, err
+		}
+		record, err := parseJSONObject(contents, elementStart, element, &i)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func parseJSONObject(contents []byte, start int64, value json.RawMessage, index *int) (jsonRecord, error) {
+	line := lineNumberAt(contents, start)
+	if value[0] != '{' {
+		return jsonRecord{}, &recordError{Line: line, Index: index, Reason: "record is not a JSON object"}
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(value, &message); err != nil {
+		return jsonRecord{}, &recordError{Line: line, Index: index, Reason: err.Error()}
+	}
+	return jsonRecord{message: message, line: line}, nil
+}
+
+// parseNDJSON parses newline delimited JSON, skipping blank lines
+func parseNDJSON(contents []byte) ([]jsonRecord, error) {
+	var records []jsonRecord
+	for lineStart := 0; lineStart < len(contents); {
+		lineEnd := bytes.IndexByte(contents[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(contents)
+		} else {
+			lineEnd += lineStart
+		}
+		lineRecords, err := parseJSONValues(contents, int64(lineStart), contents[lineStart:lineEnd], false, nil)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, lineRecords...)
+		lineStart = lineEnd + 1
+	}
+	return records, nil
+}
+
+// parseJSONSeq parses an RFC 7464 JSON text sequence, in which every record starts with
+// the record separator character
+func parseJSONSeq(contents []byte) ([]jsonRecord, error) {
+	if len(bytes.TrimSpace(contents)) > 0 && contents[0] != recordSeparator {
+		return nil, &recordError{Line: 1, Reason: "JSON text sequence must start with a record separator"}
+	}
+
+	var records []jsonRecord
+	recordStart := 1
+	for i := 0; recordStart <= len(contents); i++ {
+		recordEnd := bytes.IndexByte(contents[recordStart:], recordSeparator)
+		if recordEnd < 0 {
+			recordEnd = len(contents)
+		} else {
+			recordEnd += recordStart
+		}
+		seqRecords, err := parseJSONValues(contents, int64(recordStart), contents[recordStart:recordEnd], false, &i)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, seqRecords...)
+		recordStart = recordEnd + 1
+	}
+	return records, nil
+}
+
+// syntaxRecordError describes a JSON syntax error in the text between offsets start and end of contents
+func syntaxRecordError(contents []byte, start, end int64, err error, index *int) *recordError {
+	offset := end
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		offset = min(offset, start+syntaxErr.Offset)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errors.New("unexpected end of JSON input")
+	}
+	return &recordError{
+		Line:   bytes.Count(contents[:offset], []byte("\n")) + 1,
+		Index:  index,
+		Reason: err.Error(),
+	}
+}
@@ -0,0 +1,117 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Message formats", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	send := func(contentType, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, serverUrl+"/components", bytes.NewReader([]byte(body)))
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", validTokenContent)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	DescribeTable("accepts messages",
+		func(contentType, body string, expectedMessages []map[string]interface{}) {
+			resp := send(contentType, body)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(Equal(expectedMessages))
+		},
+		Entry("as a JSON array", "application/json", `[{"n": 1}, {"n": 2}]`,
+			[]map[string]interface{}{{"n": float64(1)}, {"n": float64(2)}}),
+		Entry("as a single JSON object", "application/json; charset=utf-8", `{"n": 1}`,
+			[]map[string]interface{}{{"n": float64(1)}}),
+		Entry("as NDJSON", "application/x-ndjson", "{\"n\": 1}\n\n{\"n\": 2}\r\n",
+			[]map[string]interface{}{{"n": float64(1)}, {"n": float64(2)}}),
+		Entry("as a JSON text sequence", "application/json-seq", "\x1e{\"n\": 1}\n\x1e{\"n\": 2}\n",
+			[]map[string]interface{}{{"n": float64(1)}, {"n": float64(2)}}),
+		Entry("as the centralizer's concatenated objects", "application/x-telemetry-json-batch", "{\"n\": 1}\n{\"n\": 2}\n",
+			[]map[string]interface{}{{"n": float64(1)}, {"n": float64(2)}}),
+		Entry("as concatenated arrays without a Content-Type", "", `[{"n": 1}] [{"n": 2}, {"n": 3}]`,
+			[]map[string]interface{}{{"n": float64(1)}, {"n": float64(2)}, {"n": float64(3)}}),
+	)
+
+	DescribeTable("reports the first failing record",
+		func(contentType, body string, expectedError map[string]interface{}) {
+			resp := send(contentType, body)
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			var respBody map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&respBody)).To(Succeed())
+			Expect(respBody).To(HaveKeyWithValue("error", Not(BeEmpty())))
+			for key, value := range expectedError {
+				Expect(respBody).To(HaveKeyWithValue(key, value))
+			}
+			if _, ok := expectedError["index"]; !ok {
+				Expect(respBody).NotTo(HaveKey("index"))
+			}
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+		},
+		Entry("by element index in a JSON array", "application/json", "[\n  {\"n\": 1},\n  \"two\",\n  {\"n\": 3}\n]",
+			map[string]interface{}{"line": float64(3), "index": float64(1)}),
+		Entry("after a JSON document", "application/json", "{\"n\": 1}\n{\"n\": 2}",
+			map[string]interface{}{"line": float64(2)}),
+		Entry("by line in NDJSON", "application/x-ndjson", "{\"n\": 1}\n{\"n\": 2\n{\"n\": 3}\n",
+			map[string]interface{}{"line": float64(2)}),
+		Entry("spanning lines in NDJSON", "application/x-ndjson", "{\"n\": 1}\n{\"n\":\n2}\n",
+			map[string]interface{}{"line": float64(2)}),
+		Entry("by record index in a JSON text sequence", "application/json-seq", "\x1e{\"n\": 1}\n\x1e{\"n\": }\n",
+			map[string]interface{}{"line": float64(2), "index": float64(1)}),
+		Entry("by line in concatenated objects", "", "{\"n\": 1}\n{\"n\": 2}\nnull\n",
+			map[string]interface{}{"line": float64(3)}),
+		Entry("by syntax error in concatenated objects", "", "{\"n\": 1}\n{\"n\": 2,}\n",
+			map[string]interface{}{"line": float64(2)}),
+	)
+
+	Context("when messages are validated", func() {
+		BeforeEach(func() {
+			envs[ValidateMessagesEnvVar] = "true"
+		})
+
+		It("reports contract violations by the line of the array element", func() {
+			resp := send("application/json", "[\n  {\"n\": 1}\n]")
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+
+			var respBody map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&respBody)).To(Succeed())
+			Expect(respBody["messages"]).To(ConsistOf(HaveKeyWithValue("line", float64(2))))
+		})
+	})
+})
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultJanitorInterval = 30 * time.Second
+
+	evictionReasonLimit        = "limit"
+	evictionReasonTTL          = "ttl"
+	evictionReasonMemoryBudget = "memory_budget"
+)
+
+// retentionPolicy bounds how long, and how much, the message store retains in addition to
+// the per user and collection message limit
+type retentionPolicy struct {
+	// ttl is how long messages are kept after they are stored, zero to keep them indefinitely
+	ttl time.Duration
+	// userTTLs override ttl for individual users
+	userTTLs map[string]time.Duration
+	// memoryBudget is the total size in bytes of the JSON encoding of the messages kept
+	// across all users and collections, zero for no budget
+	memoryBudget int64
+	// janitorInterval is how often messages are checked for expiry
+	janitorInterval time.Duration
+}
+
+func parseRetentionPolicy(source configSource) (retentionPolicy, error) {
+	policy := retentionPolicy{janitorInterval: defaultJanitorInterval}
+
+	for envVar, duration := range map[string]*time.Duration{
+		MessageTTLEnvVar:      &policy.ttl,
+		JanitorIntervalEnvVar: &policy.janitorInterval,
+	} {
+		value := source.get(envVar)
+		if value == "" {
+			continue
+		}
+		parsed, err := parsePositiveDuration(envVar, value)
+		if err != nil {
+			return retentionPolicy{}, err
+		}
+		*duration = parsed
+	}
+
+	if value := source.get(UserMessageTTLsEnvVar); value != "" {
+		var userTTLs map[string]string
+		if err := json.Unmarshal([]byte(value), &userTTLs); err != nil {
+			return retentionPolicy{}, fmt.Errorf("%s: %w", UserMessageTTLsEnvVar, err)
+		}
+		policy.userTTLs = make(map[string]time.Duration, len(userTTLs))
+		for userID, ttl := range userTTLs {
+			parsed, err := parsePositiveDuration(fmt.Sprintf("%s for user %s", UserMessageTTLsEnvVar, userID), ttl)
+			if err != nil {
+				return retentionPolicy{}, err
+			}
+			policy.userTTLs[userID] = parsed
+		}
+	}
+
+	if value := source.get(MemoryBudgetEnvVar); value != "" {
+		budget, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return retentionPolicy{}, fmt.Errorf("%s: %w", MemoryBudgetEnvVar, err)
+		}
+		if budget <= 0 {
+			return retentionPolicy{}, fmt.Errorf("%s must be a positive integer", MemoryBudgetEnvVar)
+		}
+		policy.memoryBudget = budget
+	}
+
+	return policy, nil
+}
+
+func parsePositiveDuration(name, value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be greater than 0s", name)
+	}
+	return duration, nil
+}
+
+// ttlFor returns how long the user's messages are kept, zero if they do not expire
+func (p retentionPolicy) ttlFor(userID string) time.Duration {
+	if ttl, ok := p.userTTLs[userID]; ok {
+		return ttl
+	}
+	return p.ttl
+}
+
+// eviction records messages removed from the front of one user's collection
+type eviction struct {
+	collection string
+	userID     string
+	count      int
+	reason     string
+}
+
+func recordEvictions(evictions []eviction) {
+	for _, e := range evictions {
+		metrics.evictions.add(float64(e.count), e.userID, e.collection, e.reason)
+		// Evictions for the message limit happen on almost every request once it is reached
+		if e.reason != evictionReasonLimit {
+			log.Printf("Evicted %d messages for user %s from %s: %s", e.count, e.userID, e.collection, e.reason)
+		}
+	}
+}
+
+// janitorReconfigured wakes the janitor when the config file is reloaded
+var janitorReconfigured = make(chan struct{}, 1)
+
+// reconfigureJanitor has the janitor pick up the reloaded janitor interval and apply the
+// reloaded retention policy straight away
+func reconfigureJanitor() {
+	select {
+	case janitorReconfigured <- struct{}{}:
+	default:
+		// The janitor has yet to pick up an earlier reload, and reads the current config when it does
+	}
+}
+
+// runJanitor periodically removes expired messages from the store, and expired responses from
+// the idempotency cache, until the receiver shuts down
+func runJanitor(store MessageStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			sweep(store, now)
+		case <-janitorReconfigured:
+			ticker.Reset(currentConfig().retention.janitorInterval)
+			sweep(store, time.Now())
+		case <-shuttingDown:
+			return
+		}
+	}
+}
+
+func sweep(store MessageStore, now time.Time) {
+	if err := store.Expire(now); err != nil {
+		log.Printf("Error expiring messages: %v", err)
+	}
+	idempotency.expire(now)
+}
@@ -0,0 +1,229 @@
+package main_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Retention", func() {
+	const secondTokenContent = "Bearer second-token"
+
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{JanitorIntervalEnvVar: "100ms"}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	restart := func() {
+		session.Signal(syscall.SIGTERM)
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(0))
+		session, serverUrl = startServerAndWait(envs)
+	}
+
+	// postSeq stores one message per seq, each 9 bytes long when encoded as JSON
+	postSeq := func(authHeaderContent string, seqs ...string) {
+		for _, seq := range seqs {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", authHeaderContent, []byte(`{"seq": `+seq+`}`))
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		}
+	}
+
+	seqsOf := func(authHeaderContent string) []float64 {
+		seqs := []float64{}
+		for _, message := range getMessages(serverUrl+"/received_messages", authHeaderContent) {
+			seqs = append(seqs, message["seq"].(float64))
+		}
+		return seqs
+	}
+
+	Context("with a message TTL", func() {
+		BeforeEach(func() {
+			envs[MessageTTLEnvVar] = "500ms"
+		})
+
+		It("evicts messages once they are older than the TTL", func() {
+			postSeq(validTokenContent, "1")
+			Expect(seqsOf(validTokenContent)).To(Equal([]float64{1}))
+
+			time.Sleep(300 * time.Millisecond)
+			postSeq(validTokenContent, "2")
+
+			Eventually(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(time.Second).Should(Equal([]float64{2}))
+			Eventually(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(time.Second).Should(BeEmpty())
+
+			Expect(getMetrics(serverUrl)).To(ContainSubstring(
+				`telemetry_receiver_evictions_total{user="user-id",collection="messages",reason="ttl"} 2` + "\n"))
+		})
+
+		It("keeps cursors stable as messages expire", func() {
+			postSeq(validTokenContent, "1", "2")
+			_, cursor := getMessagesPage(serverUrl + "/received_messages?limit=1")
+			Expect(cursor).NotTo(BeEmpty())
+
+			Eventually(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(2 * time.Second).Should(BeEmpty())
+			postSeq(validTokenContent, "3")
+
+			messages, _ := getMessagesPage(serverUrl + "/received_messages?cursor=" + cursor)
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0]).To(HaveKeyWithValue("seq", BeNumerically("==", 3)))
+		})
+	})
+
+	Context("with a TTL for one user", func() {
+		BeforeEach(func() {
+			envs[UserMessageTTLsEnvVar] = `{"user-id2": "300ms"}`
+		})
+
+		It("only evicts that user's messages", func() {
+			postSeq(validTokenContent, "1")
+			postSeq(secondTokenContent, "2")
+
+			Eventually(func() []float64 { return seqsOf(secondTokenContent) }).
+				WithTimeout(2 * time.Second).Should(BeEmpty())
+			Consistently(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(500 * time.Millisecond).Should(Equal([]float64{1}))
+		})
+	})
+
+	Context("with a memory budget", func() {
+		BeforeEach(func() {
+			envs[MemoryBudgetEnvVar] = "27"
+		})
+
+		It("evicts the oldest messages across all users to stay within the budget", func() {
+			postSeq(validTokenContent, "1", "2")
+			postSeq(secondTokenContent, "3", "4")
+
+			Expect(seqsOf(validTokenContent)).To(Equal([]float64{2}))
+			Expect(seqsOf(secondTokenContent)).To(Equal([]float64{3, 4}))
+
+			postSeq(secondTokenContent, "5")
+			Expect(seqsOf(validTokenContent)).To(BeEmpty())
+			Expect(seqsOf(secondTokenContent)).To(Equal([]float64{3, 4, 5}))
+
+			Expect(getMetrics(serverUrl)).To(ContainSubstring(
+				`telemetry_receiver_evictions_total{user="user-id",collection="messages",reason="memory_budget"} 2` + "\n"))
+		})
+
+		It("frees the budget when messages are cleared", func() {
+			postSeq(validTokenContent, "1", "2", "3")
+			clearMessages(serverUrl)
+
+			postSeq(secondTokenContent, "4", "5", "6")
+			Expect(seqsOf(secondTokenContent)).To(Equal([]float64{4, 5, 6}))
+		})
+	})
+
+	Context("with the file message store", func() {
+		BeforeEach(func() {
+			envs[MessageStoreEnvVar] = "file"
+			envs[MessageStorePathEnvVar] = filepath.Join(GinkgoT().TempDir(), "messages.log")
+		})
+
+		Context("and a memory budget", func() {
+			BeforeEach(func() {
+				envs[MemoryBudgetEnvVar] = "18"
+			})
+
+			It("keeps messages evicted for the budget evicted after a restart", func() {
+				postSeq(validTokenContent, "1", "2", "3")
+				Expect(seqsOf(validTokenContent)).To(Equal([]float64{2, 3}))
+
+				delete(envs, MemoryBudgetEnvVar)
+				restart()
+				Expect(seqsOf(validTokenContent)).To(Equal([]float64{2, 3}))
+			})
+		})
+
+		It("expires messages by the time they were stored before a restart", func() {
+			postSeq(validTokenContent, "1")
+			time.Sleep(time.Second)
+			postSeq(validTokenContent, "2")
+
+			envs[MessageTTLEnvVar] = "1s"
+			envs[JanitorIntervalEnvVar] = "1m"
+			restart()
+			Expect(seqsOf(validTokenContent)).To(Equal([]float64{2}))
+		})
+	})
+
+	Context("with a config file", func() {
+		var configPath string
+
+		BeforeEach(func() {
+			configPath = filepath.Join(GinkgoT().TempDir(), "config.yml")
+			Expect(os.WriteFile(configPath, []byte("janitor_interval: 1h\n"), 0600)).To(Succeed())
+			envs = map[string]string{ConfigFileEnvVar: configPath}
+		})
+
+		reload := func(contents string) {
+			Expect(os.WriteFile(configPath, []byte(contents), 0600)).To(Succeed())
+			session.Signal(syscall.SIGHUP)
+			Eventually(session.Err).Should(gbytes.Say("Reloaded config file"))
+		}
+
+		It("evicts messages older than a reloaded TTL straight away", func() {
+			postSeq(validTokenContent, "1")
+			time.Sleep(300 * time.Millisecond)
+
+			reload("janitor_interval: 1h\nmessage_ttl: 200ms\n")
+			Eventually(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(500 * time.Millisecond).Should(BeEmpty())
+		})
+
+		It("applies a reloaded janitor interval", func() {
+			reload("janitor_interval: 100ms\nmessage_ttl: 200ms\n")
+
+			postSeq(validTokenContent, "1")
+			Expect(seqsOf(validTokenContent)).To(Equal([]float64{1}))
+			Eventually(func() []float64 { return seqsOf(validTokenContent) }).
+				WithTimeout(time.Second).Should(BeEmpty())
+		})
+	})
+
+	DescribeTable("when a retention configuration is invalid, it exits nonzero",
+		func(envVar, value string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar: "50",
+				envVar:             value,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidRetentionError + ": " + envVar))
+		},
+		Entry("unparseable TTL", MessageTTLEnvVar, "forever"),
+		Entry("zero TTL", MessageTTLEnvVar, "0s"),
+		Entry("unparseable user TTLs", UserMessageTTLsEnvVar, `["1h"]`),
+		Entry("negative user TTL", UserMessageTTLsEnvVar, `{"user-id": "-1h"}`),
+		Entry("negative memory budget", MemoryBudgetEnvVar, "-1"),
+		Entry("zero janitor interval", JanitorIntervalEnvVar, "0s"),
+	)
+})
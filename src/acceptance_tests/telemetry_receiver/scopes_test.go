@@ -0,0 +1,161 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Key scopes", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(map[string]string{
+			ApiKeysEnvVar: `{
+				"user-id": [
+					"1234",
+					{"key": "ingest-token", "scopes": ["ingest"]},
+					{"key": "reader-token", "scopes": ["read"]},
+					{"key": "clear-token", "scopes": ["clear"]}
+				],
+				"ops": [{"key": "ops-token", "scopes": ["admin"]}]
+			}`,
+			AdminApiKeyEnvVar: "admin-token",
+		})
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	statusFor := func(method, path, authHeaderContent string, body []byte) int {
+		resp := makeRequest(method, serverUrl+path, authHeaderContent, body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("lets an ingest-only key send messages but not read or clear them", func() {
+		Expect(statusFor(http.MethodPost, "/components", "Bearer ingest-token", generateTelemetryMsg())).To(Equal(http.StatusCreated))
+
+		for _, path := range []string{"/received_messages", "/received_batches", "/received_messages/wait?count=1", "/stream"} {
+			Expect(statusFor(http.MethodGet, path, "Bearer ingest-token", nil)).To(Equal(http.StatusForbidden), path)
+		}
+		Expect(statusFor(http.MethodDelete, "/clear_messages", "Bearer ingest-token", nil)).To(Equal(http.StatusForbidden))
+
+		Expect(getMessages(serverUrl+"/received_messages", "Bearer reader-token")).To(HaveLen(2))
+	})
+
+	It("keeps read and clear keys from sending messages", func() {
+		Expect(statusFor(http.MethodPost, "/components", "Bearer reader-token", generateTelemetryMsg())).To(Equal(http.StatusForbidden))
+		Expect(statusFor(http.MethodDelete, "/clear_messages", "Bearer reader-token", nil)).To(Equal(http.StatusForbidden))
+		Expect(statusFor(http.MethodPost, "/components", "Bearer clear-token", generateTelemetryMsg())).To(Equal(http.StatusForbidden))
+
+		Expect(statusFor(http.MethodPost, "/components", validTokenContent, generateTelemetryMsg())).To(Equal(http.StatusCreated))
+		Expect(statusFor(http.MethodDelete, "/clear_messages", "Bearer clear-token", nil)).To(Equal(http.StatusOK))
+		Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+	})
+
+	It("still rejects unknown keys with 401", func() {
+		Expect(statusFor(http.MethodPost, "/components", "Bearer wrong-token", generateTelemetryMsg())).To(Equal(http.StatusUnauthorized))
+		Expect(statusFor(http.MethodGet, "/received_messages", "Bearer wrong-token", nil)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("lets admin keys use the admin endpoints", func() {
+		Expect(statusFor(http.MethodGet, "/admin/faults", "Bearer ops-token", nil)).To(Equal(http.StatusOK))
+		Expect(statusFor(http.MethodGet, "/admin/keys", validTokenContent, nil)).To(Equal(http.StatusForbidden))
+		Expect(statusFor(http.MethodGet, "/received_messages", "Bearer ops-token", nil)).To(Equal(http.StatusForbidden))
+	})
+
+	It("creates keys with scopes, which rotated keys keep", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/keys/ops", "Bearer ops-token", []byte(`{"scopes": ["ingest"]}`))
+		var key map[string]interface{}
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(json.NewDecoder(resp.Body).Decode(&key)).To(Succeed())
+		_ = resp.Body.Close()
+		Expect(key).To(HaveKeyWithValue("scopes", ConsistOf("ingest")))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/admin/keys/ops/"+key["fingerprint"].(string)+"/rotate", "Bearer ops-token", nil)
+		var rotated map[string]interface{}
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(json.NewDecoder(resp.Body).Decode(&rotated)).To(Succeed())
+		_ = resp.Body.Close()
+
+		token := "Bearer " + rotated["key"].(string)
+		Expect(statusFor(http.MethodPost, "/components", token, generateTelemetryMsg())).To(Equal(http.StatusCreated))
+		Expect(statusFor(http.MethodGet, "/received_messages", token, nil)).To(Equal(http.StatusForbidden))
+	})
+
+	It("keeps admin keys to the keys of their own user", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/keys/new-team", "Bearer ops-token", []byte(`{"scopes": ["ingest"]}`))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		var body map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body).To(HaveKeyWithValue("reason", "other_user"))
+		Expect(body["error"]).To(ContainSubstring(AdminApiKeyEnvVar))
+
+		Expect(statusFor(http.MethodGet, "/admin/keys/user-id", "Bearer ops-token", nil)).To(Equal(http.StatusForbidden))
+		Expect(statusFor(http.MethodPost, "/admin/keys/new-team", "Bearer admin-token", []byte(`{"scopes": ["ingest"]}`))).
+			To(Equal(http.StatusCreated))
+
+		resp = makeRequest(http.MethodGet, serverUrl+"/admin/keys", "Bearer ops-token", nil)
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(io.ReadAll(resp.Body)).NotTo(ContainSubstring("new-team"))
+	})
+
+	It("keeps admin keys to the fault rules of their own user", func() {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/faults", "Bearer admin-token",
+			[]byte(`{"match": {"user": "user-id"}, "response": {"status": 503}}`))
+		var rule map[string]interface{}
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(json.NewDecoder(resp.Body).Decode(&rule)).To(Succeed())
+		_ = resp.Body.Close()
+		ruleID := rule["id"].(string)
+
+		Expect(statusFor(http.MethodPost, "/admin/faults", "Bearer ops-token",
+			[]byte(`{"match": {"user": "user-id"}, "response": {"status": 500}}`))).To(Equal(http.StatusForbidden))
+		Expect(getMessages(serverUrl+"/admin/faults", "Bearer ops-token")).To(BeEmpty())
+		Expect(statusFor(http.MethodDelete, "/admin/faults/"+ruleID, "Bearer ops-token", nil)).To(Equal(http.StatusNotFound))
+		Expect(statusFor(http.MethodDelete, "/admin/faults", "Bearer ops-token", nil)).To(Equal(http.StatusNoContent))
+		Expect(getMessages(serverUrl+"/admin/faults", "Bearer admin-token")).To(ConsistOf(HaveKeyWithValue("id", ruleID)))
+
+		resp = makeRequest(http.MethodPost, serverUrl+"/admin/faults", "Bearer ops-token", []byte(`{"response": {"status": 500}}`))
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(json.NewDecoder(resp.Body).Decode(&rule)).To(Succeed())
+		_ = resp.Body.Close()
+		Expect(rule["match"]).To(Equal(map[string]interface{}{"user": "ops"}))
+		Expect(statusFor(http.MethodPost, "/components", "Bearer ingest-token", generateTelemetryMsg())).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("rejects keys created with unknown scopes", func() {
+		Expect(statusFor(http.MethodPost, "/admin/keys/ops", "Bearer ops-token", []byte(`{"scopes": ["write"]}`))).
+			To(Equal(http.StatusBadRequest))
+	})
+
+	DescribeTable("when scopes are invalid, it exits nonzero",
+		func(apiKeys string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      apiKeys,
+				MessageLimitEnvVar: "50",
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidApiKeyError + ": " + ApiKeysEnvVar))
+		},
+		Entry("unknown", `{"user-id": [{"key": "1234", "scopes": ["write"]}]}`),
+		Entry("empty", `{"user-id": [{"key": "1234", "scopes": []}]}`),
+	)
+})
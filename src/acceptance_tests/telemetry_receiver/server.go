@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 2 * time.Minute
+	defaultWriteTimeout      = 2 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+	// defaultShutdownTimeout leaves time to exit before CF sends SIGKILL, 10 seconds after SIGTERM
+	defaultShutdownTimeout = 8 * time.Second
+)
+
+// serverTimeouts configure the HTTP server and how long it waits for in-flight requests on shutdown
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+	shutdown   time.Duration
+}
+
+func parseServerTimeouts(source configSource) (serverTimeouts, error) {
+	timeouts := serverTimeouts{
+		readHeader: defaultReadHeaderTimeout,
+		read:       defaultReadTimeout,
+		write:      defaultWriteTimeout,
+		idle:       defaultIdleTimeout,
+		shutdown:   defaultShutdownTimeout,
+	}
+
+	for envVar, timeout := range map[string]*time.Duration{
+		ReadHeaderTimeoutEnvVar: &timeouts.readHeader,
+		ReadTimeoutEnvVar:       &timeouts.read,
+		WriteTimeoutEnvVar:      &timeouts.write,
+		IdleTimeoutEnvVar:       &timeouts.idle,
+		ShutdownTimeoutEnvVar:   &timeouts.shutdown,
+	} {
+		value := source.get(envVar)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return serverTimeouts{}, fmt.Errorf("%s: %w", envVar, err)
+		}
+		if duration <= 0 {
+			return serverTimeouts{}, fmt.Errorf("%s must be greater than 0s", envVar)
+		}
+		*timeout = duration
+	}
+
+	return timeouts, nil
+}
+
+// shuttingDown is closed when the receiver starts shutting down, so long-lived
+// /stream and /wait requests end instead of holding up the shutdown
+var shuttingDown = make(chan struct{})
+
+// extendDeadlines lifts the server's read and write timeouts for a request that
+// legitimately stays open for longer, up to the given deadline (zero for none)
+func extendDeadlines(w http.ResponseWriter, deadline time.Time) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("Error extending read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		log.Printf("Error extending write deadline: %v", err)
+	}
+}
+
+// serve runs the HTTP server, along with the forward listener if there is one, until
+// SIGTERM or SIGINT. It then stops accepting connections, waits for in-flight
+// requests to complete and closes the message store.
+func serve(addr string, timeouts serverTimeouts, forward *forwardServer) error {
+	server := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+	}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(listener) }()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-signals.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeouts.shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.shutdown)
+	defer cancel()
+
+	shutdownErr := server.Shutdown(ctx)
+	if forward != nil {
+		shutdownErr = errors.Join(shutdownErr, forward.close(ctx))
+	}
+	if shutdownErr == nil {
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			shutdownErr = err
+		}
+	}
+
+	// Requests still in flight after a timed out shutdown fail to store their messages
+	// rather than leaving a partially written log entry
+	if err := messageStore.Close(); err != nil {
+		return errors.Join(shutdownErr, fmt.Errorf("failed to close message store: %w", err))
+	}
+	if shutdownErr != nil {
+		return fmt.Errorf("failed to shut down in time: %w", shutdownErr)
+	}
+	log.Printf("Shut down")
+	return nil
+}
@@ -0,0 +1,188 @@
+package main_test
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Server lifecycle", func() {
+	const adminTokenContent = "Bearer admin-token"
+
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = map[string]string{AdminApiKeyEnvVar: "admin-token"}
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	// delayComponents makes every /components request take latencyMs before it is handled
+	delayComponents := func(latencyMs string) {
+		resp := makeRequest(http.MethodPost, serverUrl+"/admin/faults", adminTokenContent,
+			[]byte(`{"match": {"path": "/components"}, "latency_ms": `+latencyMs+`}`))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+	}
+
+	sendInBackground := func() <-chan *http.Response {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			responses <- makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+		}()
+		return responses
+	}
+
+	It("completes in-flight requests before exiting on SIGTERM", func() {
+		delayComponents("1000")
+		responses := sendInBackground()
+		time.Sleep(200 * time.Millisecond)
+
+		session.Signal(syscall.SIGTERM)
+
+		var resp *http.Response
+		Eventually(responses, 5*time.Second).Should(Receive(&resp))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(0))
+	})
+
+	It("stops accepting requests once shutdown starts", func() {
+		delayComponents("1000")
+		responses := sendInBackground()
+		time.Sleep(200 * time.Millisecond)
+
+		session.Interrupt()
+		Eventually(func() error {
+			_, err := http.Get(serverUrl + "/up")
+			return err
+		}).WithTimeout(time.Second).Should(HaveOccurred())
+
+		Eventually(responses, 5*time.Second).Should(Receive())
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(0))
+	})
+
+	It("ends open streams and long polls so they do not hold up shutdown", func() {
+		_, closeStream := openStream(serverUrl, validTokenContent)
+		defer closeStream()
+
+		waits := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			waits <- makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?timeout=1m", validTokenContent, nil)
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		session.Signal(syscall.SIGTERM)
+
+		var resp *http.Response
+		Eventually(waits, 5*time.Second).Should(Receive(&resp))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(0))
+	})
+
+	Context("when in-flight requests outlast the shutdown timeout", func() {
+		BeforeEach(func() {
+			envs[ShutdownTimeoutEnvVar] = "200ms"
+		})
+
+		It("exits nonzero", func() {
+			delayComponents("3000")
+			go func() {
+				// The receiver exits before responding
+				req, _ := http.NewRequest(http.MethodPost, serverUrl+"/components", bytes.NewReader(generateTelemetryMsg()))
+				req.Header.Set("Authorization", validTokenContent)
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+			}()
+			time.Sleep(200 * time.Millisecond)
+
+			session.Signal(syscall.SIGTERM)
+
+			Eventually(session).WithTimeout(2 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say("failed to shut down in time"))
+		})
+	})
+
+	Context("with the file message store", func() {
+		BeforeEach(func() {
+			envs[MessageStoreEnvVar] = "file"
+			envs[MessageStorePathEnvVar] = filepath.Join(GinkgoT().TempDir(), "messages.log")
+		})
+
+		It("keeps messages stored by requests that were in flight during shutdown", func() {
+			delayComponents("500")
+			responses := sendInBackground()
+			time.Sleep(100 * time.Millisecond)
+
+			session.Signal(syscall.SIGTERM)
+			Eventually(responses, 5*time.Second).Should(Receive())
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(0))
+
+			session, serverUrl = startServerAndWait(envs)
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+		})
+	})
+
+	Context("with a read header timeout", func() {
+		BeforeEach(func() {
+			envs[ReadHeaderTimeoutEnvVar] = "200ms"
+		})
+
+		It("closes connections that do not send their headers in time", func() {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(serverUrl, "http://"))
+			Expect(err).NotTo(HaveOccurred())
+			defer func() { _ = conn.Close() }()
+
+			_, err = conn.Write([]byte("GET /up HTTP/1.1\r\nHost: localhost\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(conn.SetReadDeadline(time.Now().Add(2 * time.Second))).To(Succeed())
+			_, err = conn.Read(make([]byte, 1024))
+			Expect(err).To(HaveOccurred())
+			Expect(err).NotTo(MatchError(ContainSubstring("timeout")))
+		})
+	})
+
+	DescribeTable("when a server timeout configuration is invalid, it exits nonzero",
+		func(envVar, value string) {
+			session := startServerWithEnv(binaryPath, map[string]string{
+				PortEnvVar:         "0",
+				ApiKeysEnvVar:      `{"user-id": ["1234"]}`,
+				MessageLimitEnvVar: "50",
+				envVar:             value,
+			})
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidServerTimeoutError + ": " + envVar))
+		},
+		Entry("unparseable", ReadTimeoutEnvVar, "soon"),
+		Entry("zero", WriteTimeoutEnvVar, "0s"),
+		Entry("negative", ShutdownTimeoutEnvVar, "-1s"),
+	)
+})
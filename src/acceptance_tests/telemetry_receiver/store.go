@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	messagesCollection      = "messages"
+	batchMessagesCollection = "batch_messages"
+	batchesCollection       = "batches"
+	batchArchivesCollection = "batch_archives"
+
+	memoryStoreType = "memory"
+	fileStoreType   = "file"
+
+	// compactionThreshold is the number of log entries appended to a file store
+	// before it is rewritten to contain only the messages currently retained
+	compactionThreshold = 1000
+)
+
+// MessageStore holds the messages received for each user, split into named
+// collections (one per ingestion endpoint). Implementations must be safe for
+// concurrent use by multiple HTTP handler goroutines and must never retain more
+// than the configured message limit per user and collection, nor more than the
+// retention policy allows.
+type MessageStore interface {
+	// Append stores messages along with what the receiver recorded about the request that
+	// carried them, which may be nil
+	Append(collection, userID string, receivedMessages []map[string]interface{}, metadata *receiverMetadata) error
+	Read(collection, userID string) (storedMessages, error)
+	// Expire removes the messages stored for longer than their user's TTL
+	Expire(now time.Time) error
+	// Reconfigure changes the message limit and retention policy, evicting the oldest messages
+	// beyond a lowered limit or memory budget straight away
+	Reconfigure(limit int, retention retentionPolicy) error
+	Clear(userID string) error
+	// SaveKeys replaces the API keys created through the admin API, which are kept
+	// separately from the messages and never evicted or cleared
+	SaveKeys(keys []storedKey) error
+	Keys() ([]storedKey, error)
+	Close() error
+}
+
+// storedMessages are the messages retained for one user in one collection
+type storedMessages struct {
+	Messages []map[string]interface{}
+	// Metadata holds the receiver metadata of each of Messages, or nil for a message without any
+	Metadata []*receiverMetadata
+	// Evicted counts the messages removed to stay within the message limit and retention
+	// policy since the collection was last cleared, so Evicted+i is a stable position for Messages[i]
+	Evicted int
+}
+
+func newMessageStore(storeType, path string, limit int, retention retentionPolicy) (MessageStore, error) {
+	switch storeType {
+	case "", memoryStoreType:
+		return newMemoryStore(limit, retention), nil
+	case fileStoreType:
+		return newFileStore(path, limit, retention)
+	default:
+		return nil, fmt.Errorf("unknown message store type %q", storeType)
+	}
+}
+
+// receiverMetadata is what the receiver recorded about the request that carried a message,
+// kept next to the message so the message is stored exactly as the client sent it
+type receiverMetadata struct {
+	// ContentEncoding is the Content-Encoding header the request was sent with
+	ContentEncoding string `json:",omitempty"`
+	// DetectedContentEncoding lists the compression found in the request body
+	DetectedContentEncoding string `json:",omitempty"`
+	// ForwardTag and ForwardTime are the tag and event time a forward protocol message was sent with
+	ForwardTag  string `json:",omitempty"`
+	ForwardTime string `json:",omitempty"`
+	// ForwardClientSubject is the subject of the TLS certificate the forward client presented
+	ForwardClientSubject string `json:",omitempty"`
+}
+
+// retainedMessage is a stored message along with what the retention policy needs to know about it
+type retainedMessage struct {
+	message  map[string]interface{}
+	metadata *receiverMetadata
+	storedAt time.Time
+	// size is the length of the message's JSON encoding, counted against the memory budget
+	size int64
+}
+
+// retainedMessages are the messages retained for one user in one collection, oldest first
+type retainedMessages struct {
+	entries []retainedMessage
+	evicted int
+}
+
+type memoryStore struct {
+	// mu protects collections and size, which are accessed by multiple HTTP handler
+	// goroutines simultaneously, and limit and retention, which change on reload
+	mu          sync.RWMutex
+	limit       int
+	retention   retentionPolicy
+	collections map[string]map[string]*retainedMessages
+	// size is the total size of the retained messages across all users and collections
+	size int64
+	keys []storedKey
+}
+
+func newMemoryStore(limit int, retention retentionPolicy) *memoryStore {
+	return &memoryStore{
+		limit:       limit,
+		retention:   retention,
+		collections: map[string]map[string]*retainedMessages{},
+	}
+}
+
+func (s *memoryStore) Append(collection, userID string, receivedMessages []map[string]interface{}, metadata *receiverMetadata) error {
+	recordEvictions(s.append(collection, userID, receivedMessages, metadata, time.Now()))
+	return nil
+}
+
+// append stores messages received at storedAt, then evicts the oldest messages to stay
+// within the message limit and memory budget. It returns the evictions made.
+func (s *memoryStore) append(collection, userID string, receivedMessages []map[string]interface{}, metadata *receiverMetadata, storedAt time.Time) []eviction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var evictions []eviction
+	if evicted := s.restoreLocked(collection, userID, receivedMessages, metadata, storedAt, 0); evicted > 0 {
+		evictions = append(evictions, eviction{
+			collection: collection,
+			userID:     userID,
+			count:      evicted,
+			reason:     evictionReasonLimit,
+		})
+	}
+	return append(evictions, s.enforceMemoryBudgetLocked()...)
+}
+
+// restore appends previously stored messages, carrying over how many were evicted before them.
+// Only the message limit is applied; evictions for the retention policy are restored separately.
+func (s *memoryStore) restore(collection, userID string, messages []map[string]interface{}, metadata *receiverMetadata, storedAt time.Time, evicted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restoreLocked(collection, userID, messages, metadata, storedAt, evicted)
+}
+
+// restoreLocked appends messages and returns the number of messages evicted to stay within
+// the message limit. Callers must hold s.mu.
+func (s *memoryStore) restoreLocked(collection, userID string, messages []map[string]interface{}, metadata *receiverMetadata, storedAt time.Time, evicted int) int {
+	userMessages, ok := s.collections[collection]
+	if !ok {
+		userMessages = map[string]*retainedMessages{}
+		s.collections[collection] = userMessages
+	}
+
+	curr, ok := userMessages[userID]
+	if !ok {
+		curr = &retainedMessages{}
+		userMessages[userID] = curr
+	}
+	curr.evicted += evicted
+
+	for _, message := range messages {
+		size := messageSize(message)
+		curr.entries = append(curr.entries, retainedMessage{message: message, metadata: metadata, storedAt: storedAt, size: size})
+		s.size += size
+	}
+
+	excess := len(curr.entries) - s.limit
+	if excess <= 0 {
+		return 0
+	}
+	s.removeLocked(curr, excess)
+	return excess
+}
+
+// evict removes a user's oldest messages, replaying an eviction made for the retention policy
+func (s *memoryStore) evict(collection, userID string, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if curr, ok := s.collections[collection][userID]; ok {
+		s.removeLocked(curr, min(count, len(curr.entries)))
+	}
+}
+
+// expire removes the messages stored at least their user's TTL before now and returns the evictions made
+func (s *memoryStore) expire(now time.Time) []eviction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var evictions []eviction
+	for collection, userMessages := range s.collections {
+		for userID, curr := range userMessages {
+			ttl := s.retention.ttlFor(userID)
+			if ttl <= 0 {
+				continue
+			}
+
+			expired := 0
+			for expired < len(curr.entries) && now.Sub(curr.entries[expired].storedAt) >= ttl {
+				expired++
+			}
+			if expired == 0 {
+				continue
+			}
+			s.removeLocked(curr, expired)
+			evictions = append(evictions, eviction{
+				collection: collection,
+				userID:     userID,
+				count:      expired,
+				reason:     evictionReasonTTL,
+			})
+		}
+	}
+	return evictions
+}
+
+// enforceMemoryBudget evicts the oldest messages across all users and collections until the
+// retained messages fit within the memory budget, and returns the evictions made
+func (s *memoryStore) enforceMemoryBudget() []eviction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enforceMemoryBudgetLocked()
+}
+
+// enforceMemoryBudgetLocked is enforceMemoryBudget for callers that already hold s.mu
+func (s *memoryStore) enforceMemoryBudgetLocked() []eviction {
+	if s.retention.memoryBudget <= 0 {
+		return nil
+	}
+
+	type userCollection struct{ collection, userID string }
+	evicted := map[userCollection]int{}
+	for s.size > s.retention.memoryBudget {
+		var oldest *retainedMessages
+		var oldestKey userCollection
+		for collection, userMessages := range s.collections {
+			for userID, curr := range userMessages {
+				if len(curr.entries) == 0 {
+					continue
+				}
+				if oldest == nil || curr.entries[0].storedAt.Before(oldest.entries[0].storedAt) {
+					oldest = curr
+					oldestKey = userCollection{collection: collection, userID: userID}
+				}
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		s.removeLocked(oldest, 1)
+		evicted[oldestKey]++
+	}
+
+	evictions := make([]eviction, 0, len(evicted))
+	for key, count := range evicted {
+		evictions = append(evictions, eviction{
+			collection: key.collection,
+			userID:     key.userID,
+			count:      count,
+			reason:     evictionReasonMemoryBudget,
+		})
+	}
+	return evictions
+}
+
+// removeLocked evicts the oldest count messages. Callers must hold s.mu.
+func (s *memoryStore) removeLocked(curr *retainedMessages, count int) {
+	for i := 0; i < count; i++ {
+		s.size -= curr.entries[i].size
+		// Release the message for garbage collection, as the backing array is reused
+		curr.entries[i] = retainedMessage{}
+	}
+	curr.entries = curr.entries[count:]
+	curr.evicted += count
+}
+
+// messageSize estimates the memory held by a message as the length of its JSON encoding
+func messageSize(message map[string]interface{}) int64 {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return 0
+	}
+	return int64(len(messageBytes))
+}
+
+func (s *memoryStore) Read(collection, userID string) (storedMessages, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.copyOf(collection, userID), nil
+}
+
+// copyOf returns a copy of a user's messages so callers can marshal them without
+// holding the lock. Callers must hold s.mu.
+func (s *memoryStore) copyOf(collection, userID string) storedMessages {
+	stored, ok := s.collections[collection][userID]
+	if !ok {
+		return storedMessages{Messages: []map[string]interface{}{}}
+	}
+
+	messagesCopy := make([]map[string]interface{}, len(stored.entries))
+	metadataCopy := make([]*receiverMetadata, len(stored.entries))
+	for i, entry := range stored.entries {
+		messagesCopy[i] = entry.message
+		metadataCopy[i] = entry.metadata
+	}
+	return storedMessages{Messages: messagesCopy, Metadata: metadataCopy, Evicted: stored.evicted}
+}
+
+func (s *memoryStore) Expire(now time.Time) error {
+	recordEvictions(s.expire(now))
+	return nil
+}
+
+func (s *memoryStore) Reconfigure(limit int, retention retentionPolicy) error {
+	recordEvictions(s.reconfigure(limit, retention))
+	return nil
+}
+
+// reconfigure changes the message limit and retention policy, then evicts the oldest messages
+// to stay within them. It returns the evictions made.
+func (s *memoryStore) reconfigure(limit int, retention retentionPolicy) []eviction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limit = limit
+	s.retention = retention
+
+	var evictions []eviction
+	for collection, userMessages := range s.collections {
+		for userID, curr := range userMessages {
+			excess := len(curr.entries) - s.limit
+			if excess <= 0 {
+				continue
+			}
+			s.removeLocked(curr, excess)
+			evictions = append(evictions, eviction{
+				collection: collection,
+				userID:     userID,
+				count:      excess,
+				reason:     evictionReasonLimit,
+			})
+		}
+	}
+	return append(evictions, s.enforceMemoryBudgetLocked()...)
+}
+
+func (s *memoryStore) Clear(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, userMessages := range s.collections {
+		if curr, ok := userMessages[userID]; ok {
+			for _, entry := range curr.entries {
+				s.size -= entry.size
+			}
+			delete(userMessages, userID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveKeys(keys []storedKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = slices.Clone(keys)
+	return nil
+}
+
+func (s *memoryStore) Keys() ([]storedKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.keys), nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// snapshot returns a copy of every retained message, grouped by collection and user
+func (s *memoryStore) snapshot() map[string]map[string]retainedMessages {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[string]map[string]retainedMessages, len(s.collections))
+	for collection, userMessages := range s.collections {
+		snapshot[collection] = make(map[string]retainedMessages, len(userMessages))
+		for userID, stored := range userMessages {
+			entriesCopy := make([]retainedMessage, len(stored.entries))
+			copy(entriesCopy, stored.entries)
+			snapshot[collection][userID] = retainedMessages{entries: entriesCopy, evicted: stored.evicted}
+		}
+	}
+	return snapshot
+}
+
+const (
+	appendLogOp = "append"
+	evictLogOp  = "evict"
+	clearLogOp  = "clear"
+	keysLogOp   = "keys"
+)
+
+// storeLogEntry is a single line of the file store's append-only log
+type storeLogEntry struct {
+	Op         string                   `json:"op"`
+	Collection string                   `json:"collection,omitempty"`
+	UserID     string                   `json:"user_id"`
+	Messages   []map[string]interface{} `json:"messages,omitempty"`
+	Metadata   *receiverMetadata        `json:"metadata,omitempty"`
+	// StoredAt is when appended messages were stored, so they expire on time after a restart
+	StoredAt time.Time `json:"stored_at,omitzero"`
+	// Evicted is set by compaction, to preserve the positions of the messages that follow,
+	// and by evict entries to the number of messages evicted for the retention policy
+	Evicted int `json:"evicted,omitempty"`
+	// Keys are every API key created through the admin API when the entry was written
+	Keys []storedKey `json:"keys,omitempty"`
+}
+
+// fileStore keeps an in-memory copy of all retained messages and records every
+// change in an append-only log, so messages survive a restart of the receiver.
+// The log is replayed on startup and periodically compacted down to the
+// messages still retained under the message limit and retention policy.
+type fileStore struct {
+	memory *memoryStore
+
+	// mu serializes writes to the log so it is replayed in the same order
+	// that changes were applied to memory
+	mu                     sync.Mutex
+	path                   string
+	file                   *os.File
+	entriesSinceCompaction int
+}
+
+func newFileStore(path string, limit int, retention retentionPolicy) (*fileStore, error) {
+	if path == "" {
+		return nil, errors.New("file message store requires a path")
+	}
+
+	s := &fileStore{
+		memory: newMemoryStore(limit, retention),
+		path:   path,
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	// The retention policy may have changed since the log was written; the compaction
+	// that follows persists whatever this evicts
+	recordEvictions(s.memory.expire(time.Now()))
+	recordEvictions(s.memory.enforceMemoryBudget())
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileStore) Append(collection, userID string, receivedMessages []map[string]interface{}, metadata *receiverMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storedAt := time.Now()
+	err := s.writeEntry(storeLogEntry{
+		Op:         appendLogOp,
+		Collection: collection,
+		UserID:     userID,
+		Messages:   receivedMessages,
+		Metadata:   metadata,
+		StoredAt:   storedAt,
+	})
+	if err != nil {
+		return err
+	}
+	evictions := s.memory.append(collection, userID, receivedMessages, metadata, storedAt)
+	recordEvictions(evictions)
+	// The messages are stored durably even if their evictions are not, in which case the
+	// memory budget is enforced again when the log is replayed
+	if err := s.writeEvictions(evictions); err != nil {
+		log.Printf("Error logging evictions to message store log %s: %v", s.path, err)
+	}
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *fileStore) Expire(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evictions := s.memory.expire(now)
+	recordEvictions(evictions)
+	if err := s.writeEvictions(evictions); err != nil {
+		return err
+	}
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *fileStore) Read(collection, userID string) (storedMessages, error) {
+	return s.memory.Read(collection, userID)
+}
+
+func (s *fileStore) Reconfigure(limit int, retention retentionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evictions := s.memory.reconfigure(limit, retention)
+	recordEvictions(evictions)
+	if err := s.writeEvictions(evictions); err != nil {
+		return err
+	}
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *fileStore) Clear(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeEntry(storeLogEntry{Op: clearLogOp, UserID: userID}); err != nil {
+		return err
+	}
+	if err := s.memory.Clear(userID); err != nil {
+		return err
+	}
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *fileStore) SaveKeys(keys []storedKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeEntry(storeLogEntry{Op: keysLogOp, Keys: keys}); err != nil {
+		return err
+	}
+	if err := s.memory.SaveKeys(keys); err != nil {
+		return err
+	}
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *fileStore) Keys() ([]storedKey, error) {
+	return s.memory.Keys()
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// writeEntry durably appends an entry to the log. Callers must hold s.mu.
+func (s *fileStore) writeEntry(entry storeLogEntry) error {
+	if s.file == nil {
+		return errors.New("message store is closed")
+	}
+
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message store log entry: %w", err)
+	}
+	if _, err := s.file.Write(append(entryBytes, '\n')); err != nil {
+		return fmt.Errorf("failed to write message store log: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync message store log: %w", err)
+	}
+
+	s.entriesSinceCompaction++
+	return nil
+}
+
+// writeEvictions logs the evictions made for the retention policy. Evictions for the message
+// limit are not logged, as replaying the appends evicts the same messages. Callers must hold s.mu.
+func (s *fileStore) writeEvictions(evictions []eviction) error {
+	for _, e := range evictions {
+		if e.reason == evictionReasonLimit {
+			continue
+		}
+		err := s.writeEntry(storeLogEntry{
+			Op:         evictLogOp,
+			Collection: e.collection,
+			UserID:     e.userID,
+			Evicted:    e.count,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactIfNeeded compacts the log once enough entries have accumulated.
+// Callers must hold s.mu.
+func (s *fileStore) compactIfNeeded() {
+	if s.entriesSinceCompaction < compactionThreshold {
+		return
+	}
+	// Every entry is already durable, so a failed compaction only leaves a longer log
+	if err := s.compactLocked(); err != nil {
+		log.Printf("Error compacting message store log %s: %v", s.path, err)
+	}
+}
+
+func (s *fileStore) replay() error {
+	logFile, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open message store log: %w", err)
+	}
+	defer func() { _ = logFile.Close() }()
+
+	// Each entry is written as one line, so only the last line can have been cut short
+	reader := bufio.NewReader(logFile)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read message store log: %w", err)
+		}
+		complete := err == nil
+
+		var entry storeLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if complete {
+				return fmt.Errorf("message store log %s is corrupt at line %d: %w", s.path, lineNumber, err)
+			}
+			// A partially written trailing entry is expected if the receiver was
+			// killed mid-write; it is dropped by the compaction that follows replay
+			log.Printf("Warning: ignoring partially written last entry of message store log %s: %v", s.path, err)
+			return nil
+		}
+
+		switch entry.Op {
+		case appendLogOp:
+			storedAt := entry.StoredAt
+			if storedAt.IsZero() {
+				// Logs written before messages expired have no stored time
+				storedAt = time.Now()
+			}
+			s.memory.restore(entry.Collection, entry.UserID, entry.Messages, entry.Metadata, storedAt, entry.Evicted)
+		case evictLogOp:
+			s.memory.evict(entry.Collection, entry.UserID, entry.Evicted)
+		case clearLogOp:
+			err = s.memory.Clear(entry.UserID)
+		case keysLogOp:
+			err = s.memory.SaveKeys(entry.Keys)
+		default:
+			err = fmt.Errorf("unknown message store log operation %q", entry.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fileStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the log so it only contains the retained messages and
+// reopens it for appending. Callers must hold s.mu.
+func (s *fileStore) compactLocked() error {
+	tmpPath := s.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted message store log: %w", err)
+	}
+
+	encoder := json.NewEncoder(tmpFile)
+	keys, err := s.memory.Keys()
+	if err == nil && len(keys) > 0 {
+		err = encoder.Encode(storeLogEntry{Op: keysLogOp, Keys: keys})
+	}
+	if err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to write compacted message store log: %w", err)
+	}
+	for collection, userMessages := range s.memory.snapshot() {
+		for userID, stored := range userMessages {
+			if err := encodeRetainedMessages(encoder, collection, userID, stored); err != nil {
+				_ = tmpFile.Close()
+				return fmt.Errorf("failed to write compacted message store log: %w", err)
+			}
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to sync compacted message store log: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close compacted message store log: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace message store log: %w", err)
+	}
+
+	compactedFile, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen message store log: %w", err)
+	}
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file = compactedFile
+	s.entriesSinceCompaction = 0
+	return nil
+}
+
+// encodeRetainedMessages writes one append entry for each run of a user's messages stored at
+// the same time from the same request, so they keep their stored times and receiver metadata. The first entry carries the evicted count.
+func encodeRetainedMessages(encoder *json.Encoder, collection, userID string, stored retainedMessages) error {
+	if len(stored.entries) == 0 {
+		if stored.evicted == 0 {
+			return nil
+		}
+		return encoder.Encode(storeLogEntry{
+			Op:         appendLogOp,
+			Collection: collection,
+			UserID:     userID,
+			Evicted:    stored.evicted,
+		})
+	}
+
+	evicted := stored.evicted
+	for start := 0; start < len(stored.entries); {
+		storedAt := stored.entries[start].storedAt
+		metadata := stored.entries[start].metadata
+		end := start
+		var messages []map[string]interface{}
+		for end < len(stored.entries) && stored.entries[end].storedAt.Equal(storedAt) && stored.entries[end].metadata == metadata {
+			messages = append(messages, stored.entries[end].message)
+			end++
+		}
+
+		err := encoder.Encode(storeLogEntry{
+			Op:         appendLogOp,
+			Collection: collection,
+			UserID:     userID,
+			Messages:   messages,
+			Metadata:   metadata,
+			StoredAt:   storedAt,
+			Evicted:    evicted,
+		})
+		if err != nil {
+			return err
+		}
+		evicted = 0
+		start = end
+	}
+	return nil
+}
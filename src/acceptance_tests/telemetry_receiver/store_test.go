@@ -0,0 +1,171 @@
+package main_test
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Message store", func() {
+	Describe("file", func() {
+		var (
+			session   *gexec.Session
+			serverUrl string
+			storeEnv  map[string]string
+		)
+
+		restartServer := func() {
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+			session, serverUrl = startServerAndWait(storeEnv)
+		}
+
+		BeforeEach(func() {
+			storeEnv = map[string]string{
+				MessageStoreEnvVar:     "file",
+				MessageStorePathEnvVar: filepath.Join(GinkgoT().TempDir(), "messages.log"),
+			}
+			session, serverUrl = startServerAndWait(storeEnv)
+		})
+
+		AfterEach(func() {
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+		})
+
+		It("keeps received messages across restarts", func() {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			resp = makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("best-foundation-id", true))
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			restartServer()
+
+			messages := getMessages(serverUrl+"/received_messages", validTokenContent)
+			Expect(messages).To(HaveLen(2))
+			Expect(messages[0]["telemetry-timestamp"]).To(Equal("2009-11-10T23:00:00Z"))
+			Expect(messages[1]["telemetry-timestamp"]).To(Equal("2009-11-11T23:00:00Z"))
+
+			Expect(getMessages(serverUrl+"/received_batch_messages", validTokenContent)).To(Equal([]map[string]interface{}{
+				{
+					"FoundationId": "best-foundation-id",
+					"CollectedAt":  "2006-01-02T15:04:05Z07:00",
+					"Dataset":      "opsmanager",
+				},
+			}))
+		})
+
+		It("keeps the receiver metadata of messages across restarts", func() {
+			req, err := http.NewRequest(http.MethodPost, serverUrl+"/components", bytes.NewReader(gzipContents(generateTelemetryMsg())))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", validTokenContent)
+			req.Header.Set("Content-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			restartServer()
+
+			Expect(getMessages(serverUrl+"/received_messages?metadata=true", validTokenContent)).To(HaveEach(
+				HaveKeyWithValue("receiver", map[string]interface{}{"ContentEncoding": "gzip", "DetectedContentEncoding": "gzip"}),
+			))
+		})
+
+		It("does not restore messages that were cleared", func() {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			resp = makeRequest(http.MethodPost, serverUrl+"/components", "Bearer second-token", generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			resp = makeRequest(http.MethodPost, serverUrl+"/clear_messages", validTokenContent, nil)
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			restartServer()
+
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(BeEmpty())
+			Expect(getMessages(serverUrl+"/received_messages", "Bearer second-token")).To(HaveLen(2))
+		})
+
+		It("drops a partially written last log entry", func() {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+			logFile, err := os.OpenFile(storeEnv[MessageStorePathEnvVar], os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = logFile.WriteString(`{"op":"append","collection":"messages"`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logFile.Close()).To(Succeed())
+
+			session, serverUrl = startServerAndWait(storeEnv)
+			Expect(getMessages(serverUrl+"/received_messages", validTokenContent)).To(HaveLen(2))
+		})
+
+		It("refuses to start from a log that is corrupt before its last entry", func() {
+			resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+			_ = resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			session.Kill()
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+			logPath := storeEnv[MessageStorePathEnvVar]
+			original, err := os.ReadFile(logPath)
+			Expect(err).NotTo(HaveOccurred())
+			corrupt := append([]byte("not json\n"), original...)
+			Expect(os.WriteFile(logPath, corrupt, 0600)).To(Succeed())
+
+			session = startServer(binaryPath, "0", storeEnv)
+			Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(InvalidMessageStoreError + ": .*corrupt at line 1"))
+			Expect(os.ReadFile(logPath)).To(Equal(corrupt))
+		})
+
+		It("applies the message limit to restored messages", func() {
+			storeEnv[MessageLimitEnvVar] = "3"
+			restartServer()
+
+			for i := 0; i < 2; i++ {
+				resp := makeRequest(http.MethodPost, serverUrl+"/components", validTokenContent, generateTelemetryMsg())
+				_ = resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			}
+
+			restartServer()
+
+			messages := getMessages(serverUrl+"/received_messages", validTokenContent)
+			Expect(messages).To(HaveLen(3))
+			Expect(messages[0]["telemetry-timestamp"]).To(Equal("2009-11-11T23:00:00Z"))
+		})
+	})
+
+	It("when the message store type is unknown, it exits nonzero", func() {
+		errorSession := startServer(binaryPath, "2020", map[string]string{MessageStoreEnvVar: "carrier-pigeon"})
+		Eventually(errorSession).Should(gexec.Exit(1))
+		Expect(errorSession.Out).To(gbytes.Say(InvalidMessageStoreError))
+	})
+
+	It("when the file message store has no path, it exits nonzero", func() {
+		errorSession := startServer(binaryPath, "2020", map[string]string{MessageStoreEnvVar: "file"})
+		Eventually(errorSession).Should(gexec.Exit(1))
+		Expect(errorSession.Out).To(gbytes.Say(InvalidMessageStoreError))
+	})
+})
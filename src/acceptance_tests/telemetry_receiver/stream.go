@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultStreamBufferSize = 256
+
+	// streamKeepaliveInterval is how often an idle stream sends a comment, so proxies
+	// such as the gorouter do not close it
+	streamKeepaliveInterval = 15 * time.Second
+
+	droppedStreamEvent = "dropped"
+)
+
+// streamEvent is a single message stored in a collection, as pushed to stream subscribers
+type streamEvent struct {
+	collection string
+	message    map[string]interface{}
+}
+
+// streamSubscriber receives the messages stored for one user while a /stream request is open
+type streamSubscriber struct {
+	userID string
+	events chan streamEvent
+	// dropped counts the events discarded because the subscriber's buffer was full
+	dropped atomic.Int64
+}
+
+// messageBroadcaster fans out the messages stored for each user to their stream subscribers
+type messageBroadcaster struct {
+	mu          sync.RWMutex
+	bufferSize  int
+	subscribers map[string]map[*streamSubscriber]struct{}
+}
+
+func newMessageBroadcaster(bufferSize int) *messageBroadcaster {
+	return &messageBroadcaster{
+		bufferSize:  bufferSize,
+		subscribers: map[string]map[*streamSubscriber]struct{}{},
+	}
+}
+
+func (b *messageBroadcaster) subscribe(userID string) *streamSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &streamSubscriber{
+		userID: userID,
+		events: make(chan streamEvent, b.bufferSize),
+	}
+	if _, ok := b.subscribers[userID]; !ok {
+		b.subscribers[userID] = map[*streamSubscriber]struct{}{}
+	}
+	b.subscribers[userID][sub] = struct{}{}
+	return sub
+}
+
+func (b *messageBroadcaster) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subscribers[sub.userID], sub)
+	if len(b.subscribers[sub.userID]) == 0 {
+		delete(b.subscribers, sub.userID)
+	}
+}
+
+// publish pushes messages to the user's subscribers without blocking, dropping them
+// for any subscriber whose buffer is full
+func (b *messageBroadcaster) publish(userID, collection string, messages []map[string]interface{}) {
+	// Archives duplicate the /received_batches records as base64 tarballs
+	if collection == batchArchivesCollection {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subscribers[userID] {
+		for _, message := range messages {
+			select {
+			case sub.events <- streamEvent{collection: collection, message: message}:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// streamMessages pushes every message stored for the user as a Server-Sent Event named
+// after its collection, until the client disconnects
+func streamMessages(w http.ResponseWriter, r *http.Request) {
+	userID, authed := authorized(w, r, scopeRead)
+	if !authed {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Error streaming messages for user %s: response writer does not support flushing", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub := broadcaster.subscribe(userID)
+	defer broadcaster.unsubscribe(sub)
+
+	// Streams stay open until the client disconnects
+	extendDeadlines(w, time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, ": connected\n\n"); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+
+	var reportedDropped int64
+	for {
+		var err error
+		select {
+		case event := <-sub.events:
+			if dropped := sub.dropped.Load(); dropped > reportedDropped {
+				err = writeDroppedEvent(w, userID, dropped)
+				reportedDropped = dropped
+			}
+			if err == nil {
+				err = writeStreamEvent(w, event.collection, event.message)
+			}
+		case <-keepalive.C:
+			if dropped := sub.dropped.Load(); dropped > reportedDropped {
+				err = writeDroppedEvent(w, userID, dropped)
+				reportedDropped = dropped
+			} else {
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+			}
+		case <-shuttingDown:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Printf("Error streaming messages for user %s: %v", userID, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeDroppedEvent(w http.ResponseWriter, userID string, dropped int64) error {
+	log.Printf("Stream for user %s has dropped %d messages", userID, dropped)
+	return writeStreamEvent(w, droppedStreamEvent, map[string]interface{}{"dropped": dropped})
+}
+
+func writeStreamEvent(w http.ResponseWriter, event string, data interface{}) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", event, err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, dataBytes)
+	return err
+}
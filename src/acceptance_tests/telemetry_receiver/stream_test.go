@@ -0,0 +1,168 @@
+package main_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "telemetry_receiver"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+type sseEvent struct {
+	Event string
+	Data  map[string]interface{}
+}
+
+var _ = Describe("Message stream", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+		envs      map[string]string
+	)
+
+	BeforeEach(func() {
+		envs = nil
+	})
+
+	JustBeforeEach(func() {
+		session, serverUrl = startServerAndWait(envs)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("pushes messages and batch records as they are stored", func() {
+		events, closeStream := openStream(serverUrl, validTokenContent)
+		defer closeStream()
+
+		postComponentMessages(serverUrl, componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"))
+
+		var event sseEvent
+		Eventually(events, 5*time.Second).Should(Receive(&event))
+		Expect(event.Event).To(Equal("messages"))
+		Expect(event.Data["telemetry-source"]).To(Equal("source-a"))
+
+		resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("some-foundation", true))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		var batchEvents []string
+		for i := 0; i < 2; i++ {
+			Eventually(events, 5*time.Second).Should(Receive(&event))
+			batchEvents = append(batchEvents, event.Event)
+			if event.Event == "batch_messages" {
+				Expect(event.Data["FoundationId"]).To(Equal("some-foundation"))
+			}
+		}
+		Expect(batchEvents).To(ConsistOf("batch_messages", "batches"))
+		Consistently(events, 300*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("only pushes messages stored for the subscribed user to each subscriber", func() {
+		firstEvents, closeFirst := openStream(serverUrl, validTokenContent)
+		defer closeFirst()
+		secondEvents, closeSecond := openStream(serverUrl, validTokenContent)
+		defer closeSecond()
+		otherEvents, closeOther := openStream(serverUrl, "Bearer second-token")
+		defer closeOther()
+
+		postComponentMessages(serverUrl, componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"))
+
+		Eventually(firstEvents, 5*time.Second).Should(Receive())
+		Eventually(secondEvents, 5*time.Second).Should(Receive())
+		Consistently(otherEvents, 300*time.Millisecond).ShouldNot(Receive())
+	})
+
+	Context("when a subscriber reads slower than messages arrive", func() {
+		BeforeEach(func() {
+			envs = map[string]string{StreamBufferSizeEnvVar: "1"}
+		})
+
+		It("drops messages and reports how many were dropped", func() {
+			events, closeStream := openStream(serverUrl, validTokenContent)
+			defer closeStream()
+
+			padding := strings.Repeat("x", 10000)
+			var messages []string
+			for i := 0; i < 200; i++ {
+				messages = append(messages, fmt.Sprintf(`{"telemetry-source": "source-a", "padding": %q}`, padding))
+			}
+			postComponentMessages(serverUrl, messages...)
+
+			var event sseEvent
+			Eventually(func() string {
+				select {
+				case event = <-events:
+					return event.Event
+				default:
+					return ""
+				}
+			}).WithTimeout(5 * time.Second).WithPolling(time.Millisecond).Should(Equal("dropped"))
+			Expect(event.Data["dropped"]).To(BeNumerically(">", 0))
+		})
+	})
+
+	It("rejects unauthenticated subscribers", func() {
+		resp := makeRequest(http.MethodGet, serverUrl+"/stream", "Bearer bad-token", nil)
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("when the stream buffer size configuration is invalid, it exits nonzero", func() {
+		session := startServerWithEnv(binaryPath, map[string]string{
+			PortEnvVar:             "0",
+			ApiKeysEnvVar:          `{"user-id": ["1234"]}`,
+			MessageLimitEnvVar:     "50",
+			StreamBufferSizeEnvVar: "0",
+		})
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit(1))
+		Expect(session.Out).To(gbytes.Say(InvalidStreamBufferSizeError))
+	})
+})
+
+// openStream subscribes to /stream and returns a channel of the events it receives,
+// once the receiver has registered the subscription
+func openStream(serverUrl, authHeaderContent string) (<-chan sseEvent, func()) {
+	resp := makeRequest(http.MethodGet, serverUrl+"/stream", authHeaderContent, nil)
+	Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	Expect(err).NotTo(HaveOccurred())
+	Expect(line).To(Equal(": connected\n"))
+
+	events := make(chan sseEvent, 1000)
+	go func() {
+		defer close(events)
+		var event sseEvent
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data)
+			case line == "" && event.Event != "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+
+	return events, func() { _ = resp.Body.Close() }
+}
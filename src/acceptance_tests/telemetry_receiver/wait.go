@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	countQueryParam   = "count"
+	timeoutQueryParam = "timeout"
+
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// messageNotifier wakes requests waiting for a user's messages to change
+type messageNotifier struct {
+	mu sync.Mutex
+	// changes holds a channel per user that is closed, and replaced, when the user's messages change
+	changes map[string]chan struct{}
+}
+
+func newMessageNotifier() *messageNotifier {
+	return &messageNotifier{changes: map[string]chan struct{}{}}
+}
+
+// changed returns a channel that is closed the next time the user's messages change.
+// Callers must get the channel before reading the messages so no change is missed.
+func (n *messageNotifier) changed(userID string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch, ok := n.changes[userID]
+	if !ok {
+		ch = make(chan struct{})
+		n.changes[userID] = ch
+	}
+	return ch
+}
+
+func (n *messageNotifier) notify(userID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ch, ok := n.changes[userID]; ok {
+		close(ch)
+		delete(n.changes, userID)
+	}
+}
+
+// waitForMessages responds once the collection holds at least the requested count of
+// messages matching the query, or with 408 Request Timeout if they do not arrive in time
+func waitForMessages(collection string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, authed := authorized(w, r, scopeRead)
+		if !authed {
+			return
+		}
+
+		query, err := parseMessageQuery(collection, r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		count, timeout, err := parseWaitParams(r.URL.Query(), query)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		extendDeadlines(w, time.Now().Add(timeout+timeouts.write))
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		for {
+			changed := notifier.changed(userID)
+
+			stored, err := messageStore.Read(collection, userID)
+			if err != nil {
+				log.Printf("Error reading messages for user %s: %v", userID, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			matched, nextCursor := query.page(stored)
+			if len(matched) >= count {
+				writeMessages(w, userID, matched, nextCursor)
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-timer.C:
+				writeJSONError(w, http.StatusRequestTimeout, fmt.Sprintf(
+					"timed out after %s waiting for %d messages, received %d", timeout, count, len(matched)))
+				return
+			case <-shuttingDown:
+				writeJSONError(w, http.StatusServiceUnavailable, "receiver is shutting down")
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func parseWaitParams(params url.Values, query messageQuery) (int, time.Duration, error) {
+	count := 1
+	if value := params.Get(countQueryParam); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return 0, 0, fmt.Errorf("%s must be a positive integer", countQueryParam)
+		}
+	}
+	if query.limit > 0 && count > query.limit {
+		return 0, 0, fmt.Errorf("%s must not be greater than %s", countQueryParam, limitQueryParam)
+	}
+
+	timeout := defaultWaitTimeout
+	if value := params.Get(timeoutQueryParam); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > maxWaitTimeout {
+			return 0, 0, fmt.Errorf("%s must be a duration greater than 0s and at most %s", timeoutQueryParam, maxWaitTimeout)
+		}
+	}
+
+	return count, timeout, nil
+}
@@ -0,0 +1,137 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Waiting for messages", func() {
+	var (
+		session   *gexec.Session
+		serverUrl string
+	)
+
+	BeforeEach(func() {
+		session, serverUrl = startServerAndWait(nil)
+	})
+
+	AfterEach(func() {
+		session.Kill()
+		Eventually(session).WithTimeout(5 * time.Second).Should(gexec.Exit())
+	})
+
+	It("responds once the requested number of matching messages arrive", func() {
+		postComponentMessages(serverUrl, componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"))
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			responses <- makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?source=source-a&count=2&timeout=10s", validTokenContent, nil)
+		}()
+
+		Consistently(responses, 300*time.Millisecond).ShouldNot(Receive())
+		postComponentMessages(serverUrl, componentMsg("source-b", "foundation-1", "2009-11-10T23:10:00Z"))
+		Consistently(responses, 300*time.Millisecond).ShouldNot(Receive())
+		postComponentMessages(serverUrl, componentMsg("source-a", "foundation-1", "2009-11-10T23:20:00Z"))
+
+		var resp *http.Response
+		Eventually(responses, 5*time.Second).Should(Receive(&resp))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		respBody, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		var messages []map[string]interface{}
+		Expect(json.Unmarshal(respBody, &messages)).To(Succeed())
+		Expect(messages).To(HaveLen(2))
+		Expect(messages[1]["telemetry-time"]).To(Equal("2009-11-10T23:20:00Z"))
+	})
+
+	It("responds immediately when enough messages have already arrived", func() {
+		postComponentMessages(serverUrl,
+			componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"),
+			componentMsg("source-a", "foundation-1", "2009-11-10T23:10:00Z"),
+		)
+
+		messages := getMessages(serverUrl+"/received_messages/wait?count=2&timeout=1s", validTokenContent)
+		Expect(messages).To(HaveLen(2))
+	})
+
+	It("waits for tarballs on the batch endpoints", func() {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			responses <- makeRequest(http.MethodGet, serverUrl+"/received_batch_messages/wait?foundation_id=some-foundation&timeout=10s", validTokenContent, nil)
+		}()
+
+		Consistently(responses, 300*time.Millisecond).ShouldNot(Receive())
+		resp := makeBatchRequest(http.MethodPost, serverUrl, validTokenContent, true, generateTarFileContents("some-foundation", true))
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		Eventually(responses, 5*time.Second).Should(Receive(&resp))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		Expect(getMessages(serverUrl+"/received_batches/wait?timeout=1s", validTokenContent)).To(HaveLen(1))
+	})
+
+	It("only wakes for messages sent by the same user", func() {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			responses <- makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?timeout=1s", validTokenContent, nil)
+		}()
+
+		resp := makeRequest(http.MethodPost, serverUrl+"/components", "Bearer second-token", generateTelemetryMsg())
+		_ = resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+		Eventually(responses, 5*time.Second).Should(Receive(&resp))
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestTimeout))
+	})
+
+	It("responds with 408 when the messages do not arrive in time", func() {
+		postComponentMessages(serverUrl, componentMsg("source-a", "foundation-1", "2009-11-10T23:00:00Z"))
+
+		start := time.Now()
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?count=3&timeout=500ms", validTokenContent, nil)
+		defer func() { _ = resp.Body.Close() }()
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestTimeout))
+
+		respBody, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(respBody)).To(ContainSubstring("waiting for 3 messages, received 1"))
+	})
+
+	DescribeTable("rejects invalid wait parameters",
+		func(query, expectedError string) {
+			resp := makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?"+query, validTokenContent, nil)
+			defer func() { _ = resp.Body.Close() }()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			respBody, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(respBody)).To(ContainSubstring(expectedError))
+		},
+		Entry("zero count", "count=0", "count must be a positive integer"),
+		Entry("count above limit", "count=3&limit=2", "count must not be greater than limit"),
+		Entry("unparseable timeout", "timeout=forever", "timeout must be a duration"),
+		Entry("timeout above maximum", "timeout=1h", "timeout must be a duration"),
+		Entry("invalid filter", "since=yesterday", "since must be in date/time format RFC 3339"),
+	)
+
+	It("rejects unauthenticated requests", func() {
+		resp := makeRequest(http.MethodGet, serverUrl+"/received_messages/wait?timeout=1s", "Bearer bad-token", nil)
+		defer func() { _ = resp.Body.Close() }()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})